@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pzl/phumpkin/pkg/photos"
+	"github.com/pzl/phumpkin/pkg/server"
+	"github.com/spf13/pflag"
+)
+
+// subcommands, run instead of the server. They open the database
+// directly, so the server must be stopped first.
+var commands = map[string]func(opts []server.OptFunc, args []string) error{
+	"geotag":  geotag,
+	"backup":  backup,
+	"restore": restore,
+	"export":  export,
+}
+
+func geotag(opts []server.OptFunc, args []string) error {
+	f := pflag.NewFlagSet("geotag", pflag.ExitOnError)
+	gpx := f.String("gpx", "", "GPX track file")
+	dir := f.String("dir", "", "photo directory to tag, relative to PhotoDir")
+	recur := f.BoolP("recursive", "r", false, "include subdirectories")
+	offset := f.Duration("offset", 0, "added to camera time to get UTC. e.g. -2h if the camera is set to UTC+2")
+	maxGap := f.Duration("max-gap", photos.DefaultMaxGap, "largest gap between track points to interpolate over")
+	write := f.BoolP("write", "w", false, "write matched positions to XMP sidecars. Otherwise only previews")
+	overwrite := f.Bool("overwrite", false, "replace locations photos already have")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if *gpx == "" {
+		return fmt.Errorf("--gpx is required")
+	}
+
+	matches, err := server.New(opts...).Geotag(context.Background(), photos.GeotagReq{
+		GPX:       *gpx,
+		Dir:       *dir,
+		Recursive: *recur,
+		Offset:    *offset,
+		MaxGap:    *maxGap,
+		Write:     *write,
+		Overwrite: *overwrite,
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tTAKEN (UTC)\tPOSITION\tSTATUS")
+	for _, m := range matches {
+		pos := "-"
+		if m.Matched {
+			pos = fmt.Sprintf("%.6f,%.6f", m.Lat, m.Lon)
+		}
+		status := "matched"
+		switch {
+		case m.Written:
+			status = "written"
+		case m.Reason != "":
+			status = m.Reason
+		}
+		taken := "-"
+		if !m.Taken.IsZero() {
+			taken = m.Taken.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.File, taken, pos, status)
+	}
+	return tw.Flush()
+}
+
+// where a command writes, stdout for - or nothing
+func output(name string) (io.WriteCloser, error) {
+	if name == "" || name == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(name)
+}
+
+func backup(opts []server.OptFunc, args []string) error {
+	f := pflag.NewFlagSet("backup", pflag.ExitOnError)
+	out := f.StringP("output", "o", "-", "backup file to write")
+	since := f.Uint64("since", 0, "version printed by an earlier backup, to only include changes after it")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	w, err := output(*out)
+	if err != nil {
+		return err
+	}
+	v, err := server.New(opts...).Backup(context.Background(), w, *since)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "backup version: %d\n", v)
+	return nil
+}
+
+func restore(opts []server.OptFunc, args []string) error {
+	f := pflag.NewFlagSet("restore", pflag.ExitOnError)
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 1 {
+		return fmt.Errorf("usage: restore <backup file>")
+	}
+
+	r, err := os.Open(f.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return server.New(opts...).Restore(context.Background(), r)
+}
+
+func export(opts []server.OptFunc, args []string) error {
+	f := pflag.NewFlagSet("export", pflag.ExitOnError)
+	out := f.StringP("output", "o", "-", "JSON lines file to write")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	w, err := output(*out)
+	if err != nil {
+		return err
+	}
+	n, err := server.New(opts...).Export(context.Background(), w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d photos\n", n)
+	return nil
+}
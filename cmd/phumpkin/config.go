@@ -1,11 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/pzl/mstk"
 	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/photos"
 	"github.com/pzl/phumpkin/pkg/server"
+	"github.com/pzl/phumpkin/pkg/watch"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 )
@@ -15,6 +19,18 @@ type Cfg struct {
 	PhotoDir string
 	ThumbDir string
 	DataDir  string
+	GeoNames string
+
+	AdminToken string
+
+	GCInterval string // duration
+	GCGrowth   int64  // MB
+
+	StackGap     int // ms
+	PreferSource string
+
+	Watcher      string
+	PollInterval string // duration
 }
 
 func parseCLI() []server.OptFunc {
@@ -34,8 +50,17 @@ func parseCLI() []server.OptFunc {
 		f.StringP("PhotoDir", "p", "/photos", "Directory to photo Library")
 		f.StringP("ThumbDir", "t", "/thumbs", "Directory to store thumbnails")
 		f.StringP("DataDir", "d", "/data", "Directory to store cache data, and database")
+		f.String("GeoNames", "", "GeoNames cities file (e.g. cities1000.txt) for offline reverse geocoding")
+		f.String("AdminToken", "", "token for the /api/v1/admin routes and geotagging, which are disabled without one")
+		f.String("GCInterval", "6h", "time between database garbage collection passes. 0 to disable")
+		f.Int64("GCGrowth", 512, "also collect garbage when the database grows this many MB. 0 to disable")
+		f.Int("StackGap", 1000, "longest ms between shots of a burst or bracket. 0 to not stack photos")
+		f.String("PreferSource", "raw", "which of RAW+JPEG siblings stands for the photo: raw or jpeg")
+		f.String("Watcher", "auto", "how to watch for changes: notify (inotify), poll, or auto to poll network filesystems")
+		f.String("PollInterval", "30s", "time between scans for changes when polling")
 	})
 
+	pflag.CommandLine.SetInterspersed(false) // stop at a subcommand, it parses its own flags
 	pflag.Parse()
 	if err := setLog(c.Log); err != nil { // sets verbosity and format from pflag
 		panic(err)
@@ -49,12 +74,42 @@ func parseCLI() []server.OptFunc {
 		panic(err)
 	}
 
+	gcInterval, err := time.ParseDuration(cfg.GCInterval)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.PreferSource != photos.PreferRaw && cfg.PreferSource != photos.PreferJPEG {
+		panic(fmt.Errorf("PreferSource must be %s or %s", photos.PreferRaw, photos.PreferJPEG))
+	}
+
+	switch cfg.Watcher {
+	case watch.Auto, watch.Notify, watch.Poll:
+	default:
+		panic(fmt.Errorf("Watcher must be %s, %s or %s", watch.Auto, watch.Notify, watch.Poll))
+	}
+	pollInterval, err := time.ParseDuration(cfg.PollInterval)
+	if err != nil {
+		panic(err)
+	}
+	if pollInterval <= 0 {
+		panic(fmt.Errorf("PollInterval must be positive"))
+	}
+
 	opts := []server.OptFunc{
 		server.Addr(cfg.Listen),
 		server.Log(c.Log),
 		server.Photos(cfg.PhotoDir),
 		server.Thumbs(cfg.ThumbDir),
 		server.DataDir(cfg.DataDir),
+		server.GeoNames(cfg.GeoNames),
+		server.AdminToken(cfg.AdminToken),
+		server.GCInterval(gcInterval),
+		server.GCGrowth(cfg.GCGrowth << 20),
+		server.StackGap(time.Duration(cfg.StackGap) * time.Millisecond),
+		server.PreferSource(cfg.PreferSource),
+		server.WatchMode(cfg.Watcher),
+		server.PollInterval(pollInterval),
 		server.Assets(http.FileServer(assets)), // nolint -- assets is generated
 	}
 
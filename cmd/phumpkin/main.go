@@ -4,16 +4,31 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/pzl/phumpkin/pkg/server"
+	"github.com/spf13/pflag"
 )
 
 func main() {
 	opts := parseCLI()
+	if pflag.NArg() > 0 {
+		cmd, ok := commands[pflag.Arg(0)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command: %s\n", pflag.Arg(0))
+			os.Exit(2)
+		}
+		if err := cmd(opts, pflag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	s := server.New(opts...)
 
 	ctx, cancel := context.WithCancel(context.Background())
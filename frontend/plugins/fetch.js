@@ -8,7 +8,11 @@ export default ({ app, store }, inject) => {
 			'offset=' + (store.state.images.images.length || 0),
 			"sort=" + store.state.images.sortables[store.state.images.sort].text,
 			'sort_dir=' + (store.state.images.sort_asc ? 'asc' : 'desc'),
+			'collapse=true', // one tile per burst or bracket
 		]
+		if (store.state.images.cursor) {
+			q.push('cursor=' + encodeURIComponent(store.state.images.cursor))
+		}
 		const path = url + firstJoin + q.join('&')
 		if (data !== undefined) {
 			return app.$axios.post(server + path, data)
@@ -17,4 +21,7 @@ export default ({ app, store }, inject) => {
 	}
 
 	inject('fetch', f)
+
+	// plain requests, without the grid's paging
+	inject('api', url => app.$axios.get(server + url))
 }
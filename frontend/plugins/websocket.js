@@ -23,6 +23,12 @@ export default ({ app, store }, inject) => {
 		//console.log(event)
 
 		const j = JSON.parse(event.data)
+		if ("event" in j) {
+			if (j.event === "index_status") {
+				store.commit('socket/setIndexStatus', j.data)
+			}
+			return
+		}
 		if ("_id" in j && j._id in pending) {
 			if ('error' in j) {
 				pending[j._id].reject(JSON.parse(event.data).error)
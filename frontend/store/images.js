@@ -4,11 +4,13 @@ export const state = () => ({
 	selected: [],
 	loading: false,
 	loadMore: true,
+	cursor: '', // from the last page, to continue after it
 	err: false,
 	sortables: [
 		{ text: 'Rating', icon: 'mdi-star-half' },
 		{ text: 'Date Taken', icon: 'mdi-calendar-clock' },
 		{ text: 'Name', icon: 'mdi-sort-alphabetical' },
+		{ text: 'Modified', icon: 'mdi-clock-outline' },
 	],
 	sort: 2,
 	sort_asc: true,
@@ -38,6 +40,7 @@ export const mutations = {
 	sortBy (state, by) { state.sort = by },
 	sortDir (state, dir) { state.sort_asc = dir },
 	setLoadMore (state, more) { state.loadMore = more },
+	setCursor (state, cursor) { state.cursor = cursor },
 }
 
 export const actions = {
@@ -67,6 +70,7 @@ export const actions = {
 			}
 			commit('addImages', d.photos)
 			commit('setDirs', d.dirs)
+			commit('setCursor', d.next || '')
 		})
 		.catch(error => {
 			console.log('load image error: ')
@@ -96,6 +100,7 @@ export const actions = {
 	},
 	resetImages ({ commit }) {
 		commit('setLoadMore', true)
+		commit('setCursor', '')
 		commit('clearSelection')
 		commit('clearImages')
 	},
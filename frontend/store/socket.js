@@ -1,8 +1,10 @@
 export const state = () => ({
 	connected: false,
+	indexStatus: null,
 })
 
 export const mutations = {
 	setConnected (state) { state.connected = true },
 	setDisconnected (state) { state.connected = false },
+	setIndexStatus (state, s) { state.indexStatus = s },
 }
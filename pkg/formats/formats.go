@@ -0,0 +1,92 @@
+package formats
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Photo formats.
+
+	Only files with a known extension are photos, to be indexed, listed
+	and thumbnailed. Anything else in the library, like sidecars, notes,
+	.DS_Store or darktable styles, is left alone.
+
+	Each format says how its quick thumbnails (and perceptual hashes) are
+	made: from the file itself, from the previews a camera embeds in
+	it, or only by darktable. Larger thumbnails always come from
+	darktable. Thumbnails are JPEGs named after their source without its
+	extension, so RAW+JPEG siblings share them.
+*/
+
+type Thumb int
+
+const (
+	ThumbDecode  Thumb = iota // read whole
+	ThumbPreview              // embedded previews
+	ThumbRender               // darktable, at every size
+)
+
+type Format struct {
+	Name  string
+	Exts  []string
+	Raw   bool
+	Thumb Thumb
+}
+
+const JPEG = "JPEG"
+
+var registry = []Format{
+	{Name: JPEG, Exts: []string{".jpg", ".jpeg"}, Thumb: ThumbDecode},
+	{Name: "PNG", Exts: []string{".png"}, Thumb: ThumbDecode},
+	{Name: "WebP", Exts: []string{".webp"}, Thumb: ThumbDecode},
+	{Name: "TIFF", Exts: []string{".tif", ".tiff"}, Thumb: ThumbRender},
+	{Name: "RAW", Raw: true, Thumb: ThumbPreview, Exts: []string{
+		".3fr", ".arw", ".cr2", ".cr3", ".dng", ".erf", ".iiq", ".kdc", ".mef", ".mos", ".mrw",
+		".nef", ".nrw", ".orf", ".pef", ".raf", ".raw", ".rw2", ".rwl", ".sr2", ".srf", ".srw", ".x3f",
+	}},
+}
+
+var byExt = func() map[string]Format {
+	m := make(map[string]Format)
+	for _, f := range registry {
+		for _, e := range f.Exts {
+			m[e] = f
+		}
+	}
+	return m
+}()
+
+// the format of a file, by its extension
+func Lookup(file string) (Format, bool) {
+	f, ok := byExt[strings.ToLower(filepath.Ext(file))]
+	return f, ok
+}
+
+// whether a file is a photo
+func Supported(file string) bool {
+	_, ok := Lookup(file)
+	return ok
+}
+
+func IsRaw(file string) bool {
+	f, _ := Lookup(file)
+	return f.Raw
+}
+
+func IsJPEG(file string) bool {
+	f, _ := Lookup(file)
+	return f.Name == JPEG
+}
+
+// how quick thumbnails of a file are made. Unknown files are tried for
+// embedded previews
+func ThumbOf(file string) Thumb {
+	if f, ok := Lookup(file); ok {
+		return f.Thumb
+	}
+	return ThumbPreview
+}
+
+// thumbnail name of a source file, under each size
+func ThumbName(file string) string { return strings.TrimSuffix(file, filepath.Ext(file)) + ".jpg" }
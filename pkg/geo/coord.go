@@ -0,0 +1,203 @@
+package geo
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const earthRadius = 6371008.8 // meters, mean radius
+
+// parse a coordinate into signed decimal degrees.
+//
+// accepts the formats we see from exiftool and darktable:
+//   - exiftool:   40 deg 26' 46.30" N
+//   - XMP:        40,26.771667N
+//   - decimal:    -40.446194
+func ParseCoord(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("empty coordinate")
+	}
+
+	sign := 1.0
+	switch s[len(s)-1] {
+	case 'S', 's', 'W', 'w':
+		sign = -1
+		fallthrough
+	case 'N', 'n', 'E', 'e':
+		s = strings.TrimSpace(s[:len(s)-1])
+	}
+	if strings.HasPrefix(s, "-") {
+		sign = -sign
+		s = s[1:]
+	}
+
+	// split into degrees, minutes, seconds on any of the separators in use
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		switch r {
+		case ' ', ',', '\'', '"', '°':
+			return true
+		}
+		return false
+	})
+	nums := make([]float64, 0, 3)
+	for _, p := range parts {
+		if p == "deg" {
+			continue
+		}
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0, errors.New("unable to parse coordinate: " + s)
+		}
+		nums = append(nums, f)
+	}
+
+	var dec float64
+	switch len(nums) {
+	case 3:
+		dec = nums[0] + nums[1]/60 + nums[2]/3600
+	case 2:
+		dec = nums[0] + nums[1]/60
+	case 1:
+		dec = nums[0]
+	default:
+		return 0, errors.New("unable to parse coordinate: " + s)
+	}
+	return sign * dec, nil
+}
+
+// parse an altitude into meters. ref is the GPSAltitudeRef, if separate from
+// the value (XMP). "1" means below sea level.
+//
+// accepts:
+//   - exiftool:   123.4 m Above Sea Level
+//   - XMP:        1234/10
+func ParseAltitude(s string, ref string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("empty altitude")
+	}
+
+	sign := 1.0
+	if ref == "1" || strings.Contains(s, "Below") {
+		sign = -1
+	}
+
+	f := strings.Fields(s)[0]
+	if i := strings.IndexByte(f, '/'); i != -1 {
+		num, err := strconv.ParseFloat(f[:i], 64)
+		if err != nil {
+			return 0, err
+		}
+		den, err := strconv.ParseFloat(f[i+1:], 64)
+		if err != nil {
+			return 0, err
+		}
+		if den == 0 {
+			return 0, errors.New("invalid altitude: " + s)
+		}
+		return sign * num / den, nil
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSuffix(f, "m"), 64)
+	if err != nil {
+		return 0, err
+	}
+	return sign * v, nil
+}
+
+// great-circle distance in meters
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	φ1 := lat1 * math.Pi / 180
+	φ2 := lat2 * math.Pi / 180
+	dφ := (lat2 - lat1) * math.Pi / 180
+	dλ := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dφ/2)*math.Sin(dφ/2) + math.Cos(φ1)*math.Cos(φ2)*math.Sin(dλ/2)*math.Sin(dλ/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+type BBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+var World = BBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180}
+
+// parse a "minLon,minLat,maxLon,maxLat" string (west,south,east,north)
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, errors.New("bbox expects 4 comma separated values: west,south,east,north")
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return BBox{}, errors.New("invalid bbox value: " + p)
+		}
+		v[i] = f
+	}
+	b := BBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if b.MinLat > b.MaxLat || b.MinLat < -90 || b.MaxLat > 90 {
+		return BBox{}, errors.New("invalid bbox latitudes")
+	}
+	b.MinLon = wrapLon(b.MinLon)
+	b.MaxLon = wrapLon(b.MaxLon)
+	return b, nil
+}
+
+// a box around a point, large enough to hold the radius (meters)
+func Around(lat, lon, radius float64) BBox {
+	dLat := radius / earthRadius * 180 / math.Pi
+	b := BBox{
+		MinLat: math.Max(-90, lat-dLat),
+		MaxLat: math.Min(90, lat+dLat),
+	}
+	// widest longitude span is at the latitude closest to a pole
+	c := math.Cos(math.Max(math.Abs(b.MinLat), math.Abs(b.MaxLat)) * math.Pi / 180)
+	if c < 1e-9 || radius/(earthRadius*c)*180/math.Pi >= 180 {
+		b.MinLon, b.MaxLon = -180, 180
+		return b
+	}
+	dLon := radius / (earthRadius * c) * 180 / math.Pi
+	b.MinLon = wrapLon(lon - dLon)
+	b.MaxLon = wrapLon(lon + dLon)
+	return b
+}
+
+func (b BBox) Contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon <= b.MaxLon {
+		return lon >= b.MinLon && lon <= b.MaxLon
+	}
+	// crosses the antimeridian
+	return lon >= b.MinLon || lon <= b.MaxLon
+}
+
+// split a box crossing the antimeridian into two that don't
+func (b BBox) split() []BBox {
+	if b.MinLon <= b.MaxLon {
+		return []BBox{b}
+	}
+	return []BBox{
+		{MinLat: b.MinLat, MinLon: b.MinLon, MaxLat: b.MaxLat, MaxLon: 180},
+		{MinLat: b.MinLat, MinLon: -180, MaxLat: b.MaxLat, MaxLon: b.MaxLon},
+	}
+}
+
+func wrapLon(lon float64) float64 {
+	for lon > 180 {
+		lon -= 360
+	}
+	for lon < -180 {
+		lon += 360
+	}
+	return lon
+}
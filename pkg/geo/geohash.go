@@ -0,0 +1,143 @@
+package geo
+
+import (
+	"math"
+	"strings"
+)
+
+const base32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// max geohash length we produce. 12 chars is a few centimeters
+const Precision = 12
+
+// encode a coordinate as a geohash of the given length
+func Encode(lat, lon float64, precision int) string {
+	var sb strings.Builder
+	latR := [2]float64{-90, 90}
+	lonR := [2]float64{-180, 180}
+	even := true
+	bit, ch := 0, 0
+	for sb.Len() < precision {
+		if even {
+			mid := (lonR[0] + lonR[1]) / 2
+			if lon >= mid {
+				ch |= 1 << uint(4-bit)
+				lonR[0] = mid
+			} else {
+				lonR[1] = mid
+			}
+		} else {
+			mid := (latR[0] + latR[1]) / 2
+			if lat >= mid {
+				ch |= 1 << uint(4-bit)
+				latR[0] = mid
+			} else {
+				latR[1] = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			sb.WriteByte(base32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return sb.String()
+}
+
+// the area covered by a geohash
+func DecodeBBox(hash string) BBox {
+	latR := [2]float64{-90, 90}
+	lonR := [2]float64{-180, 180}
+	even := true
+	for i := 0; i < len(hash); i++ {
+		cd := strings.IndexByte(base32, hash[i])
+		if cd == -1 {
+			break
+		}
+		for mask := 16; mask > 0; mask >>= 1 {
+			if even {
+				mid := (lonR[0] + lonR[1]) / 2
+				if cd&mask != 0 {
+					lonR[0] = mid
+				} else {
+					lonR[1] = mid
+				}
+			} else {
+				mid := (latR[0] + latR[1]) / 2
+				if cd&mask != 0 {
+					latR[0] = mid
+				} else {
+					latR[1] = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return BBox{MinLat: latR[0], MaxLat: latR[1], MinLon: lonR[0], MaxLon: lonR[1]}
+}
+
+// center point of a geohash
+func Decode(hash string) (float64, float64) {
+	b := DecodeBBox(hash)
+	return (b.MinLat + b.MaxLat) / 2, (b.MinLon + b.MaxLon) / 2
+}
+
+// cell dimensions (degrees lat, degrees lon) for a geohash length
+func cellSize(precision int) (float64, float64) {
+	bits := uint(precision * 5)
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// geohash prefixes that together cover the box, using the longest prefixes
+// that keep the count at or under maxCells. Prefixes may overhang the box, so
+// results still need to be filtered with Contains.
+func Cover(b BBox, maxCells int) []string {
+	if b.MinLat <= -90 && b.MaxLat >= 90 && b.MinLon <= -180 && b.MaxLon >= 180 {
+		return []string{""}
+	}
+
+	boxes := b.split()
+	best := []string{""}
+	for p := 1; p <= Precision; p++ {
+		dLat, dLon := cellSize(p)
+		n := 0
+		for _, bx := range boxes {
+			rows := math.Floor(bx.MaxLat/dLat) - math.Floor(bx.MinLat/dLat) + 1
+			cols := math.Floor(bx.MaxLon/dLon) - math.Floor(bx.MinLon/dLon) + 1
+			n += int(rows * cols)
+		}
+		if n > maxCells {
+			break
+		}
+
+		cells := make(map[string]struct{}, n)
+		for _, bx := range boxes {
+			for lat := bx.MinLat; ; lat += dLat {
+				if lat > bx.MaxLat {
+					lat = bx.MaxLat
+				}
+				for lon := bx.MinLon; ; lon += dLon {
+					if lon > bx.MaxLon {
+						lon = bx.MaxLon
+					}
+					cells[Encode(lat, lon, p)] = struct{}{}
+					if lon == bx.MaxLon {
+						break
+					}
+				}
+				if lat == bx.MaxLat {
+					break
+				}
+			}
+		}
+		best = make([]string, 0, len(cells))
+		for c := range cells {
+			best = append(best, c)
+		}
+	}
+	return best
+}
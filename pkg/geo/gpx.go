@@ -0,0 +1,118 @@
+package geo
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+type TrackPoint struct {
+	Time   time.Time `json:"time"`
+	Lat    float64   `json:"lat"`
+	Lon    float64   `json:"lon"`
+	Ele    float64   `json:"ele"`
+	HasEle bool      `json:"has_ele"`
+}
+
+// a GPS track, in time order
+type Track []TrackPoint
+
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele"`
+	Time string   `xml:"time"`
+}
+
+// read all timestamped points of all tracks in a GPX file
+func ReadGPX(file string) (Track, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var g gpxFile
+	if err := xml.NewDecoder(f).Decode(&g); err != nil {
+		return nil, err
+	}
+
+	t := make(Track, 0, 1000)
+	for _, trk := range g.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				tm, err := time.Parse(time.RFC3339, p.Time)
+				if err != nil {
+					continue // untimed points are no use for matching
+				}
+				tp := TrackPoint{Time: tm.UTC(), Lat: p.Lat, Lon: p.Lon}
+				if p.Ele != nil {
+					tp.Ele = *p.Ele
+					tp.HasEle = true
+				}
+				t = append(t, tp)
+			}
+		}
+	}
+	if len(t) == 0 {
+		return nil, errors.New("no timestamped track points in GPX file")
+	}
+	sort.SliceStable(t, func(i, j int) bool { return t[i].Time.Before(t[j].Time) })
+	return t, nil
+}
+
+// position at a time, interpolated between the surrounding points.
+// No position if the nearest points on either side are more than maxGap
+// apart, or the time is more than maxGap outside the track.
+func (t Track) At(tm time.Time, maxGap time.Duration) (TrackPoint, bool) {
+	if len(t) == 0 {
+		return TrackPoint{}, false
+	}
+	i := sort.Search(len(t), func(i int) bool { return !t[i].Time.Before(tm) })
+
+	switch {
+	case i < len(t) && t[i].Time.Equal(tm):
+		return t[i], true
+	case i == 0:
+		if t[0].Time.Sub(tm) > maxGap {
+			return TrackPoint{}, false
+		}
+		p := t[0]
+		p.Time = tm
+		return p, true
+	case i == len(t):
+		if tm.Sub(t[i-1].Time) > maxGap {
+			return TrackPoint{}, false
+		}
+		p := t[i-1]
+		p.Time = tm
+		return p, true
+	}
+
+	a, b := t[i-1], t[i]
+	span := b.Time.Sub(a.Time)
+	if span > maxGap {
+		return TrackPoint{}, false
+	}
+	f := float64(tm.Sub(a.Time)) / float64(span)
+	p := TrackPoint{
+		Time:   tm,
+		Lat:    a.Lat + (b.Lat-a.Lat)*f,
+		Lon:    a.Lon + (b.Lon-a.Lon)*f,
+		HasEle: a.HasEle && b.HasEle,
+	}
+	if p.HasEle {
+		p.Ele = a.Ele + (b.Ele-a.Ele)*f
+	}
+	return p, true
+}
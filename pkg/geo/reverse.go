@@ -0,0 +1,170 @@
+package geo
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// places further than this from any known city are not named
+const maxPlaceDistance = 100000 // meters
+
+type Place struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	City    string `json:"city"`
+}
+
+type city struct {
+	name    string
+	country string // ISO code
+	admin1  string // code, within country
+	lat     float64
+	lon     float64
+}
+
+// offline reverse geocoder, backed by a GeoNames dump
+type Geocoder struct {
+	cells     map[[2]int][]city // 1°x1° buckets
+	countries map[string]string // ISO code -> name
+	regions   map[string]string // "CC.admin1" -> name
+}
+
+// load a GeoNames cities file (cities500.txt, cities1000.txt, etc).
+// countryInfo.txt and admin1CodesASCII.txt are also read from the same
+// directory if present, for country and region names. Otherwise codes are used.
+func LoadGeoNames(file string) (*Geocoder, error) {
+	g := &Geocoder{
+		cells:     make(map[[2]int][]city),
+		countries: make(map[string]string),
+		regions:   make(map[string]string),
+	}
+
+	err := readTSV(file, func(f []string) {
+		if len(f) < 11 {
+			return
+		}
+		lat, err := strconv.ParseFloat(f[4], 64)
+		if err != nil {
+			return
+		}
+		lon, err := strconv.ParseFloat(f[5], 64)
+		if err != nil {
+			return
+		}
+		c := city{
+			name:    f[1],
+			country: f[8],
+			admin1:  f[10],
+			lat:     lat,
+			lon:     lon,
+		}
+		cell := cellOf(lat, lon)
+		g.cells[cell] = append(g.cells[cell], c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(file)
+	err = readTSV(filepath.Join(dir, "countryInfo.txt"), func(f []string) {
+		if len(f) > 4 {
+			g.countries[f[0]] = f[4]
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = readTSV(filepath.Join(dir, "admin1CodesASCII.txt"), func(f []string) {
+		if len(f) > 1 {
+			g.regions[f[0]] = f[1]
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// name the place nearest to a coordinate
+func (g *Geocoder) Lookup(lat, lon float64) (Place, bool) {
+	if g == nil {
+		return Place{}, false
+	}
+
+	// search every bucket that could hold something within range
+	latSpan := int(math.Ceil(maxPlaceDistance / 111000.0))
+	lonSpan := 180
+	if c := math.Cos(math.Min(89, math.Abs(lat)+float64(latSpan)) * math.Pi / 180); c > 0 {
+		lonSpan = int(math.Min(180, math.Ceil(float64(latSpan)/c)))
+	}
+
+	center := cellOf(lat, lon)
+	best := math.Inf(1)
+	var nearest *city
+	for y := center[0] - latSpan; y <= center[0]+latSpan; y++ {
+		for x := center[1] - lonSpan; x <= center[1]+lonSpan; x++ {
+			cs := g.cells[[2]int{y, wrapCell(x)}]
+			for i := range cs {
+				if d := Distance(lat, lon, cs[i].lat, cs[i].lon); d < best {
+					best = d
+					nearest = &cs[i]
+				}
+			}
+		}
+	}
+	if nearest == nil || best > maxPlaceDistance {
+		return Place{}, false
+	}
+
+	p := Place{
+		City:    nearest.name,
+		Country: nearest.country,
+		Region:  nearest.admin1,
+	}
+	if n, ok := g.countries[nearest.country]; ok {
+		p.Country = n
+	}
+	if n, ok := g.regions[nearest.country+"."+nearest.admin1]; ok {
+		p.Region = n
+	}
+	return p, true
+}
+
+func cellOf(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), wrapCell(int(math.Floor(lon)))}
+}
+
+func wrapCell(x int) int {
+	for x < -180 {
+		x += 360
+	}
+	for x >= 180 {
+		x -= 360
+	}
+	return x
+}
+
+// calls f for every non-comment line of a tab separated file
+func readTSV(file string, f func([]string)) error {
+	fh, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	sc := bufio.NewScanner(fh)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024) // alternate names can make for long lines
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f(strings.Split(line, "\t"))
+	}
+	return sc.Err()
+}
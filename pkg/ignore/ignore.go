@@ -0,0 +1,192 @@
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+	Ignore rules, from .phumpkinignore files.
+
+	They work as .gitignore files do. Each line is a pattern for paths
+	below the directory the file is in. Blank lines and lines starting
+	with # are skipped, and a leading \ escapes either. A pattern with a
+	slash before its end is relative to that directory, otherwise it
+	matches names at any depth. A trailing slash matches only
+	directories. * and ? don't cross slashes, ** does. A pattern starting
+	with ! includes again what an earlier one ignored.
+
+	The last pattern to match wins, and patterns in deeper files beat
+	shallower ones. Nothing can be included again from inside an ignored
+	directory.
+
+	Files are read once and cached. Forget a directory when its file
+	changes.
+*/
+
+const File = ".phumpkinignore"
+
+type rule struct {
+	segs     []string
+	anchored bool
+	negate   bool
+	dirOnly  bool
+}
+
+// Rules for a tree
+type Rules struct {
+	root string
+
+	mu    sync.Mutex
+	files map[string][]rule // by root-relative dir, "" for the root
+}
+
+func New(root string) *Rules {
+	return &Rules{root: filepath.Clean(root), files: make(map[string][]rule)}
+}
+
+// whether a root-relative path is ignored, it or any directory above it
+func (r *Rules) Ignored(rel string, dir bool) bool {
+	rel = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(rel)), "/")
+	if rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for i := 1; i <= len(parts); i++ {
+		if r.ignoredHere(parts[:i], dir || i < len(parts)) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the path of parts is ignored by its own rules, not its parents'
+func (r *Rules) ignoredHere(parts []string, dir bool) bool {
+	ignored := false
+	for d := 0; d < len(parts); d++ { // the files of each directory above, root first
+		for _, ru := range r.rules(strings.Join(parts[:d], "/")) {
+			if ru.match(parts[d:], dir) {
+				ignored = !ru.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// whether an absolute path is ignored. Paths outside the root never are
+func (r *Rules) IgnoredAbs(p string, dir bool) bool {
+	rel, err := filepath.Rel(r.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	return r.Ignored(rel, dir)
+}
+
+// drop the cached rules of a root-relative directory, to read them again
+func (r *Rules) Forget(dir string) {
+	dir = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(dir)), "/")
+	r.mu.Lock()
+	delete(r.files, dir)
+	r.mu.Unlock()
+}
+
+func (r *Rules) rules(dir string) []rule {
+	r.mu.Lock()
+	rs, ok := r.files[dir]
+	r.mu.Unlock()
+	if ok {
+		return rs
+	}
+	rs = readRules(filepath.Join(r.root, filepath.FromSlash(dir), File))
+	r.mu.Lock()
+	r.files[dir] = rs
+	r.mu.Unlock()
+	return rs
+}
+
+// a missing or unreadable file has no rules
+func readRules(file string) []rule {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var rs []rule
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if ru, ok := parseRule(s.Text()); ok {
+			rs = append(rs, ru)
+		}
+	}
+	return rs
+}
+
+func parseRule(line string) (rule, bool) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, "\\ ") {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || line[0] == '#' {
+		return rule{}, false
+	}
+	var ru rule
+	switch {
+	case line[0] == '!':
+		ru.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, "\\#"), strings.HasPrefix(line, "\\!"):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		ru.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		ru.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule{}, false
+	}
+	ru.segs = strings.Split(line, "/")
+	return ru, true
+}
+
+// parts is the path relative to the rule's directory
+func (ru rule) match(parts []string, dir bool) bool {
+	if ru.dirOnly && !dir {
+		return false
+	}
+	if !ru.anchored {
+		parts = parts[len(parts)-1:]
+	}
+	return matchSegs(ru.segs, parts)
+}
+
+func matchSegs(pat []string, parts []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				return len(parts) > 0 // what's inside, not the directory itself
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegs(pat[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], parts[0]); !ok {
+			return false
+		}
+		pat, parts = pat[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
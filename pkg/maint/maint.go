@@ -0,0 +1,247 @@
+package maint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	Database maintenance.
+
+	Indexing rewrites records all the time, and badger only reclaims the
+	space of old values when asked to. A pass flattens the LSM tree, so
+	badger knows which values are stale, then garbage collects the value
+	log until nothing is left worth rewriting.
+
+	Passes run on an interval, and early when the database grows by more
+	than a threshold since the last one. badger stops compacting while it
+	flattens, and wants no writes meanwhile, so writers are paused for it
+	if given a way to.
+*/
+
+const (
+	discardRatio = 0.5         // rewrite a value log file when at least this much of it is stale
+	checkEvery   = time.Minute // how often to look at growth
+	flatWorkers  = 2
+)
+
+type Opt func(m *Maintainer)
+
+// time between passes. 0 disables scheduled passes
+func Interval(d time.Duration) Opt { return func(m *Maintainer) { m.interval = d } }
+
+// bytes of growth that start a pass early. 0 disables it
+func Growth(b int64) Opt { return func(m *Maintainer) { m.growth = b } }
+
+// holds off writes to the database until the func it returns is called
+func Pause(p func() (resume func())) Opt { return func(m *Maintainer) { m.pause = p } }
+
+type Maintainer struct {
+	interval time.Duration
+	growth   int64
+	pause    func() (resume func()) // optional
+
+	db  *badger.DB
+	dir string
+	log logrus.FieldLogger
+
+	pass    sync.Mutex // one pass at a time
+	mu      sync.Mutex
+	running bool
+	last    Pass
+	base    int64 // size after the last pass
+}
+
+// what a pass did
+type Pass struct {
+	Started   time.Time     `json:"started"`
+	Took      time.Duration `json:"took"`
+	Before    int64         `json:"before"` // bytes on disk
+	After     int64         `json:"after"`
+	Reclaimed int64         `json:"reclaimed"`
+	Rewrites  int           `json:"rewrites"` // value log files rewritten
+	Error     string        `json:"error,omitempty"`
+}
+
+type Status struct {
+	LSM      int64         `json:"lsm"` // bytes
+	VLog     int64         `json:"vlog"`
+	Total    int64         `json:"total"`
+	Interval time.Duration `json:"interval"`
+	Growth   int64         `json:"growth"`
+	Running  bool          `json:"running"`
+	Last     *Pass         `json:"last,omitempty"`
+}
+
+func New(opts ...Opt) *Maintainer {
+	m := &Maintainer{
+		interval: 6 * time.Hour,
+		growth:   512 << 20,
+	}
+	for _, o := range opts {
+		if o != nil {
+			o(m)
+		}
+	}
+	return m
+}
+
+func (m *Maintainer) Start(ctx context.Context) {
+	m.db = ctx.Value("badger").(*badger.DB)
+	m.dir = ctx.Value("dataDir").(string)
+	m.log = ctx.Value("log").(logrus.FieldLogger).WithField("component", "maint")
+
+	lsm, vlog := m.size()
+	m.base = lsm + vlog
+	if m.interval <= 0 && m.growth <= 0 {
+		m.log.Info("database maintenance disabled")
+		return
+	}
+	m.log.WithFields(logrus.Fields{
+		"interval": m.interval,
+		"growth":   m.growth,
+	}).Info("beginning database maintenance loop")
+	go m.loop(ctx)
+}
+
+func (m *Maintainer) loop(ctx context.Context) {
+	check := time.NewTicker(checkEvery)
+	defer check.Stop()
+	var sched <-chan time.Time
+	if m.interval > 0 {
+		t := time.NewTicker(m.interval)
+		defer t.Stop()
+		sched = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sched:
+			m.Run()
+		case <-check.C:
+			if m.growth <= 0 {
+				continue
+			}
+			lsm, vlog := m.size()
+			m.mu.Lock()
+			grown := lsm+vlog-m.base > m.growth
+			m.mu.Unlock()
+			if grown {
+				m.log.WithField("size", lsm+vlog).Debug("database grew past threshold")
+				m.Run()
+			}
+		}
+	}
+}
+
+// run a maintenance pass now, or wait for the running one
+func (m *Maintainer) Run() Pass {
+	m.pass.Lock()
+	defer m.pass.Unlock()
+	m.mu.Lock()
+	m.running = true
+	m.mu.Unlock()
+
+	lsm, vlog := m.size()
+	p := Pass{Started: time.Now(), Before: lsm + vlog}
+
+	err := m.flatten()
+	if err != nil {
+		m.log.WithError(err).Warn("unable to flatten database")
+	}
+	for {
+		gerr := m.db.RunValueLogGC(discardRatio)
+		if gerr == nil {
+			p.Rewrites++
+			continue
+		}
+		if gerr != badger.ErrNoRewrite {
+			err = gerr
+		}
+		break
+	}
+
+	lsm, vlog = m.size()
+	p.After = lsm + vlog
+	p.Reclaimed = p.Before - p.After
+	p.Took = time.Since(p.Started)
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	m.running = false
+	m.last = p
+	m.base = p.After
+	m.mu.Unlock()
+
+	l := m.log.WithFields(logrus.Fields{
+		"before":    p.Before,
+		"after":     p.After,
+		"reclaimed": p.Reclaimed,
+		"rewrites":  p.Rewrites,
+		"took":      p.Took,
+	})
+	if err != nil {
+		l.WithError(err).Error("database maintenance failed")
+	} else {
+		l.Info("database maintenance done")
+	}
+	return p
+}
+
+func (m *Maintainer) flatten() error {
+	if m.pause != nil {
+		resume := m.pause()
+		defer resume()
+	}
+	return m.db.Flatten(flatWorkers)
+}
+
+func (m *Maintainer) Status() Status {
+	lsm, vlog := m.size()
+	s := Status{
+		LSM:      lsm,
+		VLog:     vlog,
+		Total:    lsm + vlog,
+		Interval: m.interval,
+		Growth:   m.growth,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.Running = m.running
+	if !m.last.Started.IsZero() {
+		last := m.last
+		s.Last = &last
+	}
+	return s
+}
+
+// bytes on disk now. badger's own Size is only refreshed every minute,
+// too slow to see what a pass reclaimed
+func (m *Maintainer) size() (lsm int64, vlog int64) {
+	err := filepath.Walk(m.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil // files come and go during compaction
+		}
+		switch {
+		case strings.HasSuffix(path, ".sst"):
+			lsm += fi.Size()
+		case strings.HasSuffix(path, ".vlog"):
+			vlog += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return m.db.Size()
+	}
+	return lsm, vlog
+}
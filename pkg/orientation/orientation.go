@@ -0,0 +1,122 @@
+package orientation
+
+import (
+	"image"
+	"strconv"
+	"strings"
+)
+
+// EXIF orientation, numbered as in the spec.
+// https://www.daveperrett.com/articles/2012/07/28/exif-orientation-handling-is-a-ghetto/
+//
+// Each value describes how the stored image must be transformed for display
+type Orientation int
+
+const (
+	Invalid           Orientation = 0
+	Normal            Orientation = 1
+	MirrorHoriz       Orientation = 2
+	Rot180            Orientation = 3
+	MirrorVert        Orientation = 4
+	MirrorHorizRot270 Orientation = 5 // transpose
+	Rot90             Orientation = 6 // clockwise
+	MirrorHorizRot90  Orientation = 7 // transverse
+	Rot270            Orientation = 8 // clockwise
+)
+
+// exiftool's names for each
+var names = map[Orientation]string{
+	Normal:            "Horizontal (normal)",
+	MirrorHoriz:       "Mirror horizontal",
+	Rot180:            "Rotate 180",
+	MirrorVert:        "Mirror vertical",
+	MirrorHorizRot270: "Mirror horizontal and rotate 270 CW",
+	Rot90:             "Rotate 90 CW",
+	MirrorHorizRot90:  "Mirror horizontal and rotate 90 CW",
+	Rot270:            "Rotate 270 CW",
+}
+
+func (o Orientation) String() string {
+	if n, ok := names[o]; ok {
+		return n
+	}
+	return "invalid"
+}
+
+// parse exiftool's text, or the numeric value
+func Parse(s string) Orientation {
+	s = strings.TrimSpace(s)
+	for o, n := range names {
+		if strings.EqualFold(s, n) {
+			return o
+		}
+	}
+	if i, err := strconv.Atoi(s); err == nil && i >= 1 && i <= 8 {
+		return Orientation(i)
+	}
+	return Invalid
+}
+
+// from an exif map value, which may have been decoded as a string or number
+func FromValue(v interface{}) Orientation {
+	switch n := v.(type) {
+	case string:
+		return Parse(n)
+	case float64:
+		if n >= 1 && n <= 8 {
+			return Orientation(n)
+		}
+	case int:
+		if n >= 1 && n <= 8 {
+			return Orientation(n)
+		}
+	}
+	return Invalid
+}
+
+// whether width and height trade places for display
+func (o Orientation) SwapsDimensions() bool { return o >= MirrorHorizRot270 && o <= Rot270 }
+
+// transform an image for display. Invalid and Normal return img as-is
+func (o Orientation) Apply(img image.Image) image.Image {
+	if o <= Normal || o > Rot270 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o.SwapsDimensions() {
+		dw, dh = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := o.dest(x, y, w, h)
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// where a stored pixel lands for display, in a w x h image
+func (o Orientation) dest(x, y, w, h int) (int, int) {
+	switch o {
+	case MirrorHoriz:
+		return w - 1 - x, y
+	case Rot180:
+		return w - 1 - x, h - 1 - y
+	case MirrorVert:
+		return x, h - 1 - y
+	case MirrorHorizRot270:
+		return y, x
+	case Rot90:
+		return h - 1 - y, x
+	case MirrorHorizRot90:
+		return h - 1 - y, w - 1 - x
+	case Rot270:
+		return y, w - 1 - x
+	}
+	return x, y
+}
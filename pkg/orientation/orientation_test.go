@@ -0,0 +1,127 @@
+package orientation
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// 2x3, each pixel numbered by where it's stored
+//
+//	0 1
+//	2 3
+//	4 5
+func numbered() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 2, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 2; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(y*2 + x)})
+		}
+	}
+	return img
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		o    Orientation
+		want [][]uint8 // displayed rows
+	}{
+		{Normal, [][]uint8{{0, 1}, {2, 3}, {4, 5}}},
+		{MirrorHoriz, [][]uint8{{1, 0}, {3, 2}, {5, 4}}},
+		{Rot180, [][]uint8{{5, 4}, {3, 2}, {1, 0}}},
+		{MirrorVert, [][]uint8{{4, 5}, {2, 3}, {0, 1}}},
+		{MirrorHorizRot270, [][]uint8{{0, 2, 4}, {1, 3, 5}}},
+		{Rot90, [][]uint8{{4, 2, 0}, {5, 3, 1}}},
+		{MirrorHorizRot90, [][]uint8{{5, 3, 1}, {4, 2, 0}}},
+		{Rot270, [][]uint8{{1, 3, 5}, {0, 2, 4}}},
+	}
+	for _, tt := range tests {
+		out := tt.o.Apply(numbered())
+		b := out.Bounds()
+		if b.Dx() != len(tt.want[0]) || b.Dy() != len(tt.want) {
+			t.Errorf("%v: got %dx%d, want %dx%d", tt.o, b.Dx(), b.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, v := range row {
+				if g := color.GrayModel.Convert(out.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y; g != v {
+					t.Errorf("%v: pixel %d,%d is %d, want %d", tt.o, x, y, g, v)
+				}
+			}
+		}
+		if got := b.Dx() != 2; got != tt.o.SwapsDimensions() {
+			t.Errorf("%v: SwapsDimensions %v, but dimensions swapped %v", tt.o, tt.o.SwapsDimensions(), got)
+		}
+	}
+}
+
+func TestApplyUnchanged(t *testing.T) {
+	for _, o := range []Orientation{Invalid, Normal, 9, -1} {
+		img := numbered()
+		if out := o.Apply(img); out != image.Image(img) {
+			t.Errorf("%d: image was transformed", o)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Orientation
+	}{
+		{"Horizontal (normal)", Normal},
+		{"Mirror horizontal", MirrorHoriz},
+		{"Rotate 180", Rot180},
+		{"Mirror vertical", MirrorVert},
+		{"Mirror horizontal and rotate 270 CW", MirrorHorizRot270},
+		{"Rotate 90 CW", Rot90},
+		{"Mirror horizontal and rotate 90 CW", MirrorHorizRot90},
+		{"Rotate 270 CW", Rot270},
+		{"rotate 90 cw", Rot90},
+		{" Rotate 180 ", Rot180},
+		{"6", Rot90},
+		{"1", Normal},
+		{"0", Invalid},
+		{"9", Invalid},
+		{"", Invalid},
+		{"Unknown (0)", Invalid},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.in); got != tt.want {
+			t.Errorf("Parse(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFromValue(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want Orientation
+	}{
+		{"Rotate 270 CW", Rot270},
+		{"3", Rot180},
+		{float64(6), Rot90},
+		{float64(0), Invalid},
+		{float64(9), Invalid},
+		{7, MirrorHorizRot90},
+		{12, Invalid},
+		{nil, Invalid},
+		{true, Invalid},
+	}
+	for _, tt := range tests {
+		if got := FromValue(tt.in); got != tt.want {
+			t.Errorf("FromValue(%#v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	for o := Normal; o <= Rot270; o++ {
+		if Parse(o.String()) != o {
+			t.Errorf("%d: %q doesn't parse back", o, o.String())
+		}
+	}
+	if Orientation(9).String() != "invalid" {
+		t.Errorf("9: got %q", Orientation(9).String())
+	}
+}
@@ -0,0 +1,64 @@
+package phash
+
+import (
+	"image"
+	"math/bits"
+)
+
+/*
+	Perceptual hashing, for finding images that look alike.
+
+	dHash: the image is shrunk to 9x8 gray, and each bit says whether a
+	pixel is brighter than the one to its right. Resizing, recompression
+	and small exposure changes flip few bits, so similar images are a
+	small Hamming distance apart.
+*/
+
+const (
+	width  = 9
+	height = 8
+)
+
+// 64 bit difference hash of an image
+func DHash(img image.Image) uint64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+
+	// box average into a 9x8 grid of luminance. Every source pixel lands
+	// in exactly one cell
+	var sum [height][width]float64
+	var n [height][width]int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * height / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * width / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sum[cy][cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			n[cy][cx]++
+		}
+	}
+	var gray [height][width]float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if n[y][x] > 0 {
+				gray[y][x] = sum[y][x] / float64(n[y][x])
+			}
+		}
+	}
+
+	var h uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			h <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// number of differing bits
+func Distance(a, b uint64) int { return bits.OnesCount64(a ^ b) }
@@ -0,0 +1,240 @@
+package photos
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	Database backup, restore and export.
+
+	Backups are badger's streaming format, and hold everything in the
+	database, schema version included. Each returns a version; passing
+	it to the next backup only writes what changed since. Restores are
+	loaded aside and migrated, since a backup may be older than this
+	build, then replace the whole database.
+
+	Exports are JSON lines, one per photo, of the records read from its
+	files. They're meant for other tools, and can't be restored.
+*/
+
+const (
+	restoreWrites = 256     // how many pending writes a restore may have in flight
+	backupFrame   = 1 << 28 // largest frame of a backup, far more than badger writes
+)
+
+// write a backup of the database, of changes after since (0 for everything).
+// Returns the version to pass as since next time
+func Backup(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	db := ctx.Value("badger").(*badger.DB)
+	return db.Backup(w, since)
+}
+
+// replace the database with a backup. The backup is loaded and migrated
+// in a database of its own first, so a bad one leaves the index as it
+// was. Indexing waits while the index is swapped. Should the swap fail
+// partway, the index is emptied to be rebuilt from the library rather
+// than left with part of the backup. If the watcher is running, the index
+// is reconciled afterwards to catch up with what changed on disk since
+// the backup was taken, or to rebuild it
+func (m *Mgr) Restore(r io.Reader) error {
+	idx := &m.indexer
+	if idx.db == nil {
+		return errors.New("indexer not started")
+	}
+
+	// beside the live database, not in it, where its files would count as its own
+	parent, prefix := "", "phumpkin-restore-"
+	if idx.dataDir != "" {
+		parent, prefix = filepath.Dir(idx.dataDir), filepath.Base(idx.dataDir)+".restore-"
+	}
+	dir, err := ioutil.TempDir(parent, prefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) // nolint
+	staged, err := badger.Open(badger.DefaultOptions(dir).WithLogger(idx.log))
+	if err != nil {
+		return err
+	}
+	defer staged.Close() // nolint
+	if err := stage(staged, r, idx.photoDir, idx.log); err != nil {
+		return err
+	}
+
+	err = func() error {
+		idx.reconciling.Lock()
+		defer idx.reconciling.Unlock()
+		idx.pause.Lock()
+		defer idx.pause.Unlock()
+
+		idx.log.Warn("restoring database from backup")
+		err := idx.db.DropAll()
+		if err == nil {
+			pr, pw := io.Pipe()
+			go func() {
+				_, err := staged.Backup(pw, 0)
+				pw.CloseWithError(err) // nolint
+			}()
+			err = idx.db.Load(pr, restoreWrites)
+			pr.CloseWithError(err) // nolint
+		}
+		if err != nil {
+			idx.log.WithError(err).Error("restore failed partway. Emptying the index to rebuild it from the library")
+			if derr := idx.db.DropAll(); derr != nil {
+				idx.log.WithError(derr).Error("unable to empty the index")
+			} else if derr := writeSchemaVersion(idx.db, schemaVersion); derr != nil {
+				idx.log.WithError(derr).Error("unable to write schema version")
+			}
+		}
+		return err
+	}()
+
+	if idx.watcher != nil {
+		go func() {
+			if _, err := idx.reconcile(idx.ctx); err != nil {
+				idx.log.WithError(err).Error("unable to reconcile restored index")
+			}
+		}()
+	}
+	return err
+}
+
+// load a backup into an empty database, and migrate it
+func stage(db *badger.DB, r io.Reader, photoDir string, log logrus.FieldLogger) error {
+	if err := db.Load(&frames{r: r}, restoreWrites); err != nil {
+		return fmt.Errorf("reading backup: %w", err)
+	}
+	err := db.View(func(tx *badger.Txn) error {
+		_, err := tx.Get(schemaKey)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return errors.New("not a backup, it has no schema version")
+	} else if err != nil {
+		return err
+	}
+	_, err = migrate(db, photoDir, log)
+	return err
+}
+
+// reads a backup stream, failing on frames too large to be badger's.
+// Load would try to allocate whatever a corrupt length says
+type frames struct {
+	r    io.Reader
+	hdr  []byte // what's left of the current frame's length
+	left uint64 // bytes of the current frame still to read
+}
+
+func (f *frames) Read(p []byte) (int, error) {
+	if len(f.hdr) == 0 && f.left == 0 { // next frame, checked before passing on its length
+		var hdr [8]byte
+		if n, err := io.ReadFull(f.r, hdr[:]); err == io.EOF {
+			return 0, err
+		} else if err != nil {
+			return n, errors.New("not a backup, or a corrupt one")
+		}
+		f.left = binary.LittleEndian.Uint64(hdr[:])
+		if f.left > backupFrame {
+			return 0, errors.New("not a backup, or a corrupt one")
+		}
+		f.hdr = hdr[:]
+	}
+	if len(f.hdr) > 0 {
+		n := copy(p, f.hdr)
+		f.hdr = f.hdr[n:]
+		return n, nil
+	}
+	if uint64(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= uint64(n)
+	return n, err
+}
+
+// a line of an export
+type exported struct {
+	File   string          `json:"file"`
+	EXIF   json.RawMessage `json:"exif,omitempty"`
+	EXIFAt *time.Time      `json:"exif_read,omitempty"`
+	XMP    json.RawMessage `json:"xmp,omitempty"`
+	XMPAt  *time.Time      `json:"xmp_read,omitempty"`
+}
+
+// write every photo's EXIF and XMP records as JSON lines. Returns the
+// number of photos written
+func Export(ctx context.Context, w io.Writer) (int, error) {
+	db := ctx.Value("badger").(*badger.DB)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	err := db.View(func(tx *badger.Txn) error {
+		read := func(file string, src byte) (json.RawMessage, *time.Time, error) {
+			d, err := getValue(tx, DataKey(file, src))
+			if err == badger.ErrKeyNotFound {
+				return nil, nil, nil
+			} else if err != nil {
+				return nil, nil, err
+			}
+			var at *time.Time
+			if b, err := getValue(tx, TimeKey(file, src)); err == nil {
+				var t time.Time
+				if t.UnmarshalBinary(b) == nil {
+					at = &t
+				}
+			}
+			return d, at, nil
+		}
+
+		// every indexed photo has EXIF. Sidecars of photos that don't are
+		// written on their own after
+		for _, src := range []byte{SourceEXIF, SourceXMP} {
+			pfx := []byte{primaryRecord, src, DataRecord}
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = pfx
+			it := tx.NewIterator(opts)
+			for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+				e := exported{File: string(it.Item().Key()[len(pfx):])}
+				var err error
+				if src == SourceXMP {
+					if _, err := tx.Get(DataKey(e.File, SourceEXIF)); err == nil {
+						continue // written with its EXIF
+					}
+				} else if e.EXIF, e.EXIFAt, err = read(e.File, SourceEXIF); err != nil {
+					it.Close()
+					return err
+				}
+				if e.XMP, e.XMPAt, err = read(e.File, SourceXMP); err != nil {
+					it.Close()
+					return err
+				}
+				if err := enc.Encode(e); err != nil {
+					it.Close()
+					return err
+				}
+				n++
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
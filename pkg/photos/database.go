@@ -2,6 +2,7 @@ package photos
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -27,14 +28,57 @@ import (
 		for the non-time records, JSON encoded.
 			map[string]interface{} for EXIF, XMP for xmp
 		for the time records, a binary marshalled time.Time
+		for the index list records, every index key written for this
+			file and source, each prefixed by its uvarint length
+		for the hash records (EXIF only), JSON, see hash.go
 
 
 
 	Index Data:
 	-------------
-	key: indexRecord + <sourceType> + []byte(fieldname) + 0 + []byte(value) + 0 + []byte(fileID)
+	key: indexRecord + <sourceType> + part(fieldname) + part(value) + part(fileID)
 	value: []byte{}
 
+		where part() is escaped and terminated, see keys.go
+
+
+	Text Data:
+	-------------
+	key: textRecord + part(word) + part(fileID) + <sourceType>
+	value: one byte, the word's weight for ranking. See text.go
+
+		written and listed along with the index data of the source
+		the words came from
+
+
+	Directory Data:
+	-------------
+	key: dirRecord + part(parent dir) + 'f' + part(file name)
+	value: JSON dirEntry, sort keys for listing and stacks. See dirs.go, stacks.go
+
+	key: dirRecord + part(parent dir) + 'd' + part(dir name)
+	value: []byte{}
+
+		the photoDir itself is ""
+
+
+	Sort Data:
+	-------------
+	key: sortRecord + <sortKind> + part(parent dir) + part(sort value) + part(file name)
+	value: []byte{}
+
+		kept alongside the directory entries. Name order is the
+		directory entries themselves
+
+
+	Perceptual Hashes:
+	-------------
+	key: phashRecord + <chunk> + uint16(chunk of hash) + uint64(hash) + []byte(fileID)
+	value: []byte{}
+
+		x4, one per 16 bit chunk of the hash, for Hamming distance
+		lookups. Written and listed with the EXIF index data. See phash.go
+
 
 	values seem to be one of:
 		- string (some of them very long, like AFAreaXPosition)
@@ -50,7 +94,7 @@ import (
 
 	- Delete all for fileID:
 		+ DEL primaryRecord+EXIF+fileID, DEL primaryRecord+XMP+fileID (+times)
-		+ DEL .. need to find indexes
+		+ DEL each key in the index list records, and the lists themselves
 	- Get all unique values for a field
 		+ prefix = indexRecord+source+field+0, collect all the values up
 		+ iteratorOptions.Prefix is a thing (on top of seek, validForPfx, etc)
@@ -67,6 +111,11 @@ import (
 const (
 	primaryRecord byte = iota + 1
 	indexRecord
+	metaRecord // database bookkeeping, see schema.go
+	textRecord
+	dirRecord
+	sortRecord
+	phashRecord
 )
 
 const (
@@ -77,6 +126,8 @@ const (
 const (
 	DataRecord byte = iota + 1
 	TimestampRecord
+	IdxListRecord
+	HashRecord // content hash, EXIF source only. see hash.go
 )
 
 // key helpers
@@ -86,6 +137,9 @@ func TimeKey(file string, source byte) []byte {
 func DataKey(file string, source byte) []byte {
 	return append([]byte{primaryRecord, source, DataRecord}, []byte(file)...)
 }
+func IdxListKey(file string, source byte) []byte {
+	return append([]byte{primaryRecord, source, IdxListRecord}, []byte(file)...)
+}
 
 func Read(ctx context.Context, key []byte, into interface{}) error {
 	warnIfAbsolute(ctx, key[3])
@@ -135,34 +189,6 @@ func Write(ctx context.Context, sourceType byte, file string, data interface{},
 	})
 }
 
-func WriteIdxField(ctx context.Context, sourceType byte, file string, field string, v []byte, batch *badger.WriteBatch) error {
-	warnIfAbsolute(ctx, []byte(file)[0])
-	db, err := dbHandle(ctx)
-	if err != nil {
-		return err
-	}
-
-	fileb := []byte(file)
-	fieldb := []byte(field)
-
-	key := make([]byte, len(fileb)+len(fieldb)+len(v)+4) // extras are: recordType, sourceType, and 2*null-sep
-	key[0] = indexRecord
-	key[1] = sourceType
-	copy(key[2:], fieldb)
-	key[2+len(fieldb)] = 0
-	copy(key[3+len(fieldb):], v)
-	key[3+len(fieldb)+len(v)] = 0 // ?? separator v could contain ANYTHING
-	copy(key[4+len(fieldb)+len(v):], fileb)
-
-	if batch != nil {
-		return batch.SetEntry(badger.NewEntry(key, nil).WithDiscard())
-	}
-	return db.Update(func(tx *badger.Txn) error {
-		return tx.SetEntry(badger.NewEntry(key, nil).WithDiscard())
-	})
-
-}
-
 /* ---- write helpers ----------- */
 
 type EntrySetter interface {
@@ -193,6 +219,78 @@ func marshalForWrite(v interface{}) ([]byte, []byte, error) {
 	return d, t, nil
 }
 
+// runs fn in a read-write transaction, retrying if another writer got there first
+func update(db *badger.DB, fn func(tx *badger.Txn) error) error {
+	for {
+		err := db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+// update, waiting out any restore in progress
+func (idx *Indexer) update(fn func(tx *badger.Txn) error) error {
+	idx.pause.RLock()
+	defer idx.pause.RUnlock()
+	return update(idx.db, fn)
+}
+
+func encodeKeyList(keys [][]byte) []byte {
+	n := 0
+	for _, k := range keys {
+		n += binary.MaxVarintLen64 + len(k)
+	}
+	b := make([]byte, 0, n)
+	var l [binary.MaxVarintLen64]byte
+	for _, k := range keys {
+		b = append(b, l[:binary.PutUvarint(l[:], uint64(len(k)))]...)
+		b = append(b, k...)
+	}
+	return b
+}
+
+func decodeKeyList(b []byte) ([][]byte, error) {
+	var keys [][]byte
+	for len(b) > 0 {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 || uint64(len(b)-sz) < n {
+			return nil, errors.New("corrupt index list record")
+		}
+		b = b[sz:]
+		keys = append(keys, b[:n:n])
+		b = b[n:]
+	}
+	return keys, nil
+}
+
+// deletes the index keys listed for a file and source, except those in keep
+func deleteIdxList(tx *badger.Txn, file string, source byte, keep [][]byte) error {
+	v, err := getValue(tx, IdxListKey(file, source))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	old, err := decodeKeyList(v)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]struct{}, len(keep))
+	for _, k := range keep {
+		kept[string(k)] = struct{}{}
+	}
+	for _, k := range old {
+		if _, ok := kept[string(k)]; ok {
+			continue
+		}
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /* ---- Read helpers ----- */
 
 func getValue(tx *badger.Txn, key []byte) ([]byte, error) {
@@ -0,0 +1,131 @@
+package photos
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Debouncing watch events.
+
+	Copying a file writes it in many chunks, each an event. Every path
+	waits on its own until its events stop for a quiet period, or until a
+	cap if they never do, then is indexed once. A directory waiting to be
+	indexed takes in the paths below it, and waits for them, since
+	indexing it covers them.
+*/
+
+const (
+	debounceQuiet = 1500 * time.Millisecond
+	debounceMax   = 10 * time.Second
+)
+
+type debounced struct {
+	first time.Time // first event since it was last indexed
+	last  time.Time
+	dir   bool
+}
+
+type debouncer struct {
+	quiet time.Duration
+	max   time.Duration
+	tick  time.Duration
+	fire  func(path string)
+
+	mu      sync.Mutex
+	pending map[string]*debounced
+	timer   *time.Timer
+	stopped bool
+}
+
+// fire is called, on its own goroutine, for each path once it settles
+func newDebouncer(quiet time.Duration, max time.Duration, fire func(path string)) *debouncer {
+	return &debouncer{
+		quiet:   quiet,
+		max:     max,
+		tick:    quiet / 4,
+		fire:    fire,
+		pending: make(map[string]*debounced),
+	}
+}
+
+// an event for a path. dir if it's a directory, to be indexed as a whole
+func (d *debouncer) add(p string, dir bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	now := time.Now()
+	defer d.arm()
+
+	for a := path.Dir(p); a != "." && a != "/" && a != ""; a = path.Dir(a) {
+		if e, ok := d.pending[a]; ok && e.dir {
+			e.last = now
+			return
+		}
+	}
+
+	e, ok := d.pending[p]
+	if !ok {
+		e = &debounced{first: now}
+		d.pending[p] = e
+	}
+	e.last = now
+	if dir && !e.dir {
+		e.dir = true
+		for q, qe := range d.pending {
+			if strings.HasPrefix(q, p+"/") {
+				if qe.first.Before(e.first) {
+					e.first = qe.first
+				}
+				delete(d.pending, q)
+			}
+		}
+	}
+}
+
+// check back while anything waits. Locked
+func (d *debouncer) arm() {
+	if d.timer == nil && len(d.pending) > 0 {
+		d.timer = time.AfterFunc(d.tick, d.flush)
+	}
+}
+
+// fire every path that's settled, or waited long enough
+func (d *debouncer) flush() {
+	d.mu.Lock()
+	d.timer = nil
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	due := make([]string, 0, len(d.pending))
+	for p, e := range d.pending {
+		if now.Sub(e.last) >= d.quiet || now.Sub(e.first) >= d.max {
+			due = append(due, p)
+			delete(d.pending, p)
+		}
+	}
+	d.arm()
+	d.mu.Unlock()
+
+	for _, p := range due {
+		go d.fire(p)
+	}
+}
+
+// drop whatever is waiting, and ignore new events
+func (d *debouncer) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.pending = nil
+}
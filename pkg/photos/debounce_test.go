@@ -0,0 +1,208 @@
+package photos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pzl/phumpkin/pkg/watch"
+)
+
+const (
+	testQuiet = 40 * time.Millisecond
+	testMax   = 200 * time.Millisecond
+)
+
+// paths fired, in order, with when
+type fired struct {
+	mu    sync.Mutex
+	paths []string
+	at    []time.Time
+}
+
+func (f *fired) fire(p string) {
+	f.mu.Lock()
+	f.paths = append(f.paths, p)
+	f.at = append(f.at, time.Now())
+	f.mu.Unlock()
+}
+
+func (f *fired) counts() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(map[string]int)
+	for _, p := range f.paths {
+		c[p]++
+	}
+	return c
+}
+
+func TestDebounceBurst(t *testing.T) {
+	var f fired
+	d := newDebouncer(testQuiet, testMax, f.fire)
+	defer d.stop()
+
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 100; j++ {
+			d.add("a/"+strconv.Itoa(j)+".jpg", false)
+		}
+	}
+	time.Sleep(4 * testQuiet)
+
+	c := f.counts()
+	if len(c) != 100 {
+		t.Fatalf("fired %d paths, want 100", len(c))
+	}
+	for p, n := range c {
+		if n != 1 {
+			t.Errorf("%s fired %d times, want once", p, n)
+		}
+	}
+}
+
+func TestDebounceMax(t *testing.T) {
+	var f fired
+	d := newDebouncer(testQuiet, testMax, f.fire)
+	defer d.stop()
+
+	start := time.Now()
+	for time.Since(start) < 3*testMax { // never quiet
+		d.add("a.jpg", false)
+		time.Sleep(testQuiet / 4)
+	}
+	end := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.at) < 2 {
+		t.Fatalf("fired %d times while written to, want at least 2", len(f.at))
+	}
+	if first := f.at[0].Sub(start); first < testMax || first > testMax+testQuiet {
+		t.Errorf("first fired after %v, want about %v", first, testMax)
+	}
+	if f.at[len(f.at)-1].After(end) {
+		t.Errorf("fired after writes stopped, want only at max while written to")
+	}
+}
+
+func TestDebounceDir(t *testing.T) {
+	var f fired
+	d := newDebouncer(testQuiet, testMax, f.fire)
+	defer d.stop()
+
+	d.add("a/1.jpg", false)
+	d.add("a/b/2.jpg", false)
+	d.add("c.jpg", false)
+	d.add("a", true)
+	d.mu.Lock()
+	if len(d.pending) != 2 {
+		t.Errorf("%d pending after the directory, want a and c.jpg", len(d.pending))
+	}
+	d.mu.Unlock()
+
+	time.Sleep(testQuiet / 2)
+	d.add("a/3.jpg", false) // taken in, and keeps a waiting
+	time.Sleep(testQuiet / 2)
+	if n := f.counts()["a"]; n != 0 {
+		t.Errorf("a fired while a child had just changed")
+	}
+
+	time.Sleep(4 * testQuiet)
+	c := f.counts()
+	want := map[string]int{"a": 1, "c.jpg": 1}
+	if len(c) != len(want) {
+		t.Errorf("fired %v, want %v", c, want)
+	}
+	for p, n := range want {
+		if c[p] != n {
+			t.Errorf("%s fired %d times, want %d", p, c[p], n)
+		}
+	}
+}
+
+func TestDebounceStop(t *testing.T) {
+	var f fired
+	d := newDebouncer(testQuiet, testMax, f.fire)
+
+	d.add("a.jpg", false)
+	d.add("b", true)
+	d.stop()
+	d.add("c.jpg", false)
+	time.Sleep(4 * testQuiet)
+
+	if c := f.counts(); len(c) != 0 {
+		t.Errorf("fired %v after stop, want nothing", c)
+	}
+}
+
+// events as the watcher gets them, through what it does with them
+func TestDebounceEvents(t *testing.T) {
+	idx, _, done := testIndexer(t)
+	defer done()
+	idx.watcher = watch.NewPoller(time.Hour)
+	defer idx.watcher.Close()
+	var f fired
+	d := newDebouncer(testQuiet, testMax, f.fire)
+	defer d.stop()
+
+	touch := func(rel string) string {
+		full := filepath.Join(idx.photoDir, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(full, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return full
+	}
+	send := func(op fsnotify.Op, full string) { idx.handle(fsnotify.Event{Name: full, Op: op}, d) }
+
+	// a burst of copies, written in chunks, and their sidecars
+	for i := 0; i < 20; i++ {
+		full := touch("a/" + strconv.Itoa(i) + ".jpg")
+		send(fsnotify.Create, full)
+		for j := 0; j < 10; j++ {
+			send(fsnotify.Write, full)
+		}
+		send(fsnotify.Write, touch("a/"+strconv.Itoa(i)+".jpg.xmp"))
+	}
+	notes := touch("a/notes.txt")
+	send(fsnotify.Create, notes)
+	send(fsnotify.Write, notes)
+
+	// a new directory, with photos already in it and more to come
+	send(fsnotify.Create, touch("b/1.jpg"))
+	send(fsnotify.Create, filepath.Join(idx.photoDir, "b"))
+	send(fsnotify.Write, touch("b/1.jpg"))
+	send(fsnotify.Create, touch("b/c/2.jpg"))
+
+	// a rename, paired with its create, is a move and isn't indexed
+	send(fsnotify.Rename, filepath.Join(idx.photoDir, "d/old.jpg"))
+	send(fsnotify.Create, touch("e/old.jpg"))
+
+	time.Sleep(4 * testQuiet)
+	c := f.counts()
+	want := map[string]int{"b": 1}
+	for i := 0; i < 20; i++ {
+		want["a/"+strconv.Itoa(i)+".jpg"] = 1
+	}
+	if len(c) != len(want) {
+		t.Errorf("fired %d paths, want %d: %v", len(c), len(want), c)
+	}
+	for p, n := range want {
+		if c[p] != n {
+			t.Errorf("%s fired %d times, want %d", p, c[p], n)
+		}
+	}
+	if err := idx.watcher.Remove(filepath.Join(idx.photoDir, "b")); err != nil {
+		t.Errorf("new directory not watched: %v", err)
+	}
+	if olds := idx.moves.list(); len(olds) != 0 {
+		t.Errorf("renames %v left unpaired", olds)
+	}
+}
@@ -0,0 +1,481 @@
+package photos
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+	Directory listings from the index.
+
+	The indexer keeps an entry for every file under its directory, with
+	what's needed to sort a listing, and an entry for every directory
+	under its parent. Each file is also kept in a sorted index per
+	directory for every sort order besides name, which is the order of
+	the entries themselves. Listing a directory is then a range scan from
+	a cursor, and only the page being returned touches the disk.
+
+	Cursors are the sort index key of the last photo returned, past the
+	directory. They stay valid as photos come and go around them.
+*/
+
+// sort keys of a file, for listing
+type dirEntry struct {
+	Taken      string `json:"taken,omitempty"` // DateTimeOriginal, as read
+	ExifRating int    `json:"exif_rating,omitempty"`
+	XMPRating  *int   `json:"xmp_rating,omitempty"` // nil without a (darktable) sidecar
+	ModTime    int64  `json:"mtime,omitempty"`      // of the source file, unix ns
+
+	// for stacking, see stacks.go
+	Shot  int64      `json:"shot,omitempty"` // capture time, unix ms
+	Body  string     `json:"body,omitempty"` // camera model and serial number
+	Seq   string     `json:"seq,omitempty"`  // SequenceNumber, as read
+	EV    string     `json:"ev,omitempty"`   // ExposureCompensation, as read
+	Stack *StackInfo `json:"stack,omitempty"`
+
+	// RAW+JPEG siblings, see siblings.go
+	Primary  string   `json:"primary,omitempty"`  // on the others, the preferred source's name
+	Siblings []string `json:"siblings,omitempty"` // on the preferred source, the others' names
+}
+
+// sort orders with their own index
+const (
+	sortName     byte = 'n' // the directory entries
+	sortTaken    byte = 't'
+	sortRating   byte = 'r'
+	sortModified byte = 'm'
+)
+
+var sortKinds = []byte{sortTaken, sortRating, sortModified}
+
+// sort order by the names the frontend uses
+func parseSort(s string) byte {
+	switch strings.ToLower(s) {
+	case "date taken", "taken":
+		return sortTaken
+	case "rating":
+		return sortRating
+	case "modified", "mtime":
+		return sortModified
+	}
+	return sortName
+}
+
+// the entry's value in a sort order, as bytes that sort the same way
+func (e dirEntry) sortValue(kind byte) string {
+	switch kind {
+	case sortTaken:
+		return e.Taken
+	case sortRating:
+		return string([]byte{byte(int8(e.rating())) ^ 0x80})
+	case sortModified:
+		var b [8]byte
+		t := e.ModTime
+		if t < 0 {
+			t = 0
+		}
+		binary.BigEndian.PutUint64(b[:], uint64(t))
+		return string(b[:])
+	}
+	return ""
+}
+
+// the rating shown for a photo, see Photo.Meta
+func (e dirEntry) rating() int {
+	if e.XMPRating != nil {
+		return *e.XMPRating
+	}
+	return e.ExifRating
+}
+
+// update a file's sort keys from newly indexed fields of a source
+func (e *dirEntry) set(source byte, fields [][2]string) {
+	get := func(name string) string {
+		for _, f := range fields {
+			if f[0] == name {
+				return f[1]
+			}
+		}
+		return ""
+	}
+	switch source {
+	case SourceEXIF:
+		e.Taken = get("DateTimeOriginal")
+		e.ExifRating, _ = strconv.Atoi(get("Rating"))
+		e.Shot = shotTime(get("SubSecDateTimeOriginal"), e.Taken, get("SubSecTimeOriginal"))
+		serial := get("SerialNumber")
+		if serial == "" {
+			serial = get("InternalSerialNumber")
+		}
+		e.Body = strings.TrimSpace(get("Model") + " " + serial)
+		e.Seq = get("SequenceNumber")
+		e.EV = get("ExposureCompensation")
+	case SourceXMP:
+		e.XMPRating = nil
+		if get("derived_from") != "" { // populated whenever darktable wrote the sidecar
+			r, _ := strconv.Atoi(get("rating"))
+			e.XMPRating = &r
+		}
+	}
+}
+
+func getDirEntry(tx *badger.Txn, file string) (dirEntry, error) {
+	var e dirEntry
+	v, err := getValue(tx, dirKey(file, dirFile))
+	if err != nil {
+		return e, err
+	}
+	return e, json.Unmarshal(v, &e)
+}
+
+// a photo's directory entry, empty if it isn't indexed
+func (p *Photo) dirEntry() dirEntry {
+	var e dirEntry
+	db, err := dbHandle(p.ctx)
+	if err != nil {
+		return e
+	}
+	if err := fetchJSON(db, dirKey(p.Relpath(), dirFile), &e); err != nil {
+		return dirEntry{}
+	}
+	return e
+}
+
+// read-modify-write a file's entry and its sort keys, adding its directories if needed
+func updateDirEntry(tx *badger.Txn, file string, fn func(e *dirEntry)) error {
+	e, err := getDirEntry(tx, file)
+	exists := err == nil
+	if err == badger.ErrKeyNotFound {
+		if err := ensureDirs(tx, path.Dir(file)); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	old := e
+	fn(&e)
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(dirKey(file, dirFile), v); err != nil {
+		return err
+	}
+	for _, kind := range sortKinds {
+		if exists {
+			if old.sortValue(kind) == e.sortValue(kind) {
+				continue
+			}
+			if err := tx.Delete(sortKey(kind, file, old.sortValue(kind))); err != nil {
+				return err
+			}
+		}
+		if err := tx.Set(sortKey(kind, file, e.sortValue(kind)), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove a file's entry and sort keys
+func deleteDirEntry(tx *badger.Txn, file string) error {
+	e, err := getDirEntry(tx, file)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, kind := range sortKinds {
+		if err := tx.Delete(sortKey(kind, file, e.sortValue(kind))); err != nil {
+			return err
+		}
+	}
+	return tx.Delete(dirKey(file, dirFile))
+}
+
+// make sure a directory, and the ones above it, are listed in their parents
+func ensureDirs(tx *badger.Txn, dir string) error {
+	for dir != "." && dir != "/" && dir != "" {
+		k := dirKey(dir, dirSub)
+		if _, err := tx.Get(k); err == nil {
+			return nil // parents were added with it
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := tx.Set(k, nil); err != nil {
+			return err
+		}
+		dir = path.Dir(dir)
+	}
+	return nil
+}
+
+// every file and directory below dir (not including it), at any depth
+func dirTree(tx *badger.Txn, dir string) (files []string, dirs []string) {
+	scan := func(pfx []byte, f func(string)) {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			if p, _, err := parseDirKey(it.Item().Key()); err == nil {
+				f(p)
+			}
+		}
+	}
+	queue := []string{dir}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		scan(dirPrefix(d, dirFile), func(p string) { files = append(files, p) })
+		scan(dirPrefix(d, dirSub), func(p string) {
+			dirs = append(dirs, p)
+			queue = append(queue, p)
+		})
+	}
+	return files, dirs
+}
+
+type ListReq struct {
+	Offset   int
+	Count    int
+	Sort     string
+	Asc      bool
+	Path     string
+	Cursor   string // continue after this, instead of Offset
+	Collapse bool   // show only the cover of each stack
+}
+
+var ErrBadCursor = errors.New("invalid cursor")
+
+func encodeCursor(kind byte, pos []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{kind}, pos...))
+}
+
+// position in a sort order. Cursors from another order are rejected
+func decodeCursor(kind byte, c string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	if err != nil || len(b) < 1 || b[0] != kind {
+		return nil, ErrBadCursor
+	}
+	return b[1:], nil
+}
+
+// position of a file in a sort order, for paging through results that
+// span directories
+func pagePos(kind byte, file string, e dirEntry) []byte {
+	if kind == sortName {
+		return appendPart(nil, file)
+	}
+	return appendPart(appendPart(nil, e.sortValue(kind)), file)
+}
+
+// file name from a position
+func posName(kind byte, pos []byte) (string, error) {
+	if kind != sortName {
+		var err error
+		if _, pos, err = readPart(pos); err != nil {
+			return "", err
+		}
+	}
+	name, _, err := readPart(pos)
+	return name, err
+}
+
+// a page of photos from a directory, and its subdirectories, from the index,
+// with a cursor to the next page if there is one. Returns false when the
+// index can't answer yet, and the caller should look at the disk instead
+func (m *Mgr) List(ctx context.Context, lr ListReq) ([]Photo, []string, string, bool, error) {
+	photoDir := ctx.Value("photoDir").(string)
+	db := ctx.Value("badger").(*badger.DB)
+
+	select {
+	case <-m.indexer.ready:
+	default:
+		return nil, nil, "", false, nil // still building
+	}
+
+	dir := strings.TrimPrefix(path.Clean("/"+lr.Path), "/")
+	kind := parseSort(lr.Sort)
+	var after []byte
+	if lr.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(kind, lr.Cursor); err != nil {
+			return nil, nil, "", true, err
+		}
+	}
+	if lr.Count <= 0 {
+		lr.Count = 30
+	}
+	if lr.Offset < 0 || after != nil {
+		lr.Offset = 0
+	}
+
+	pfx := sortPrefix(kind, dir)
+	if kind == sortName {
+		pfx = dirPrefix(dir, dirFile)
+	}
+
+	names := make([]string, 0, lr.Count)
+	dirs := make([]string, 0, 20)
+	var next string
+	err := db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		opts.Reverse = !lr.Asc
+		it := tx.NewIterator(opts)
+		defer it.Close()
+
+		seek := append(append([]byte{}, pfx...), after...)
+		if after == nil && !lr.Asc {
+			seek = append(seek, 0xFF) // past every key under the prefix
+		}
+		skip := lr.Offset
+		var last []byte
+		for it.Seek(seek); it.ValidForPrefix(pfx); it.Next() {
+			pos := it.Item().Key()[len(pfx):]
+			if after != nil && bytes.Equal(pos, after) {
+				continue
+			}
+			name, err := posName(kind, pos)
+			if err != nil {
+				continue
+			}
+			file := path.Join(dir, name)
+			e, err := getDirEntry(tx, file)
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			if !lr.shows(e) || m.indexer.skips(file, false) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(names) == lr.Count {
+				next = encodeCursor(kind, last) // there's more
+				break
+			}
+			names = append(names, file)
+			last = append(last[:0], pos...)
+		}
+
+		dpfx := dirPrefix(dir, dirSub)
+		dopts := badger.DefaultIteratorOptions
+		dopts.PrefetchValues = false
+		dopts.Prefix = dpfx
+		dit := tx.NewIterator(dopts)
+		defer dit.Close()
+		for dit.Seek(dpfx); dit.ValidForPrefix(dpfx); dit.Next() {
+			if p, _, err := parseDirKey(dit.Item().Key()); err == nil && !m.indexer.skips(p, true) {
+				dirs = append(dirs, path.Base(p))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, "", true, err
+	}
+	if len(names) == 0 && len(dirs) == 0 && dir != "" && after == nil && lr.Offset == 0 {
+		return nil, nil, "", false, nil // not indexed, or not there at all
+	}
+
+	ps := make([]Photo, 0, len(names))
+	for _, n := range names {
+		ps = append(ps, Photo{Src: filepath.Join(photoDir, n), ctx: ctx})
+	}
+	sort.Strings(dirs)
+	return ps, dirs, next, true, nil
+}
+
+// a page of already-found photos (from a query), ordered the same way
+// directory listings are, with a cursor to the next page if there is one
+func Page(ctx context.Context, ps []Photo, lr ListReq) ([]Photo, string, error) {
+	db := ctx.Value("badger").(*badger.DB)
+
+	kind := parseSort(lr.Sort)
+	var after []byte
+	if lr.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(kind, lr.Cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	if lr.Count <= 0 {
+		lr.Count = 30
+	}
+	if lr.Offset < 0 {
+		lr.Offset = 0
+	}
+
+	type positioned struct {
+		p   Photo
+		pos []byte
+	}
+	all := make([]positioned, 0, len(ps))
+	seen := make(map[string]bool, len(ps))
+	err := db.View(func(tx *badger.Txn) error {
+		for _, p := range ps {
+			e, err := getDirEntry(tx, p.Relpath())
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			if e.Primary != "" { // found by a sibling, stands for its photo
+				p = primaryPhoto(ctx, p, e)
+				if e, err = getDirEntry(tx, p.Relpath()); err != nil && err != badger.ErrKeyNotFound {
+					return err
+				}
+			}
+			rel := p.Relpath()
+			if seen[rel] || !lr.shows(e) {
+				continue
+			}
+			seen[rel] = true
+			all = append(all, positioned{p, pagePos(kind, rel, e)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	before := func(a, b []byte) bool {
+		if lr.Asc {
+			return bytes.Compare(a, b) < 0
+		}
+		return bytes.Compare(a, b) > 0
+	}
+	sort.Slice(all, func(i, j int) bool { return before(all[i].pos, all[j].pos) })
+
+	start := lr.Offset
+	if after != nil {
+		start = sort.Search(len(all), func(i int) bool { return before(after, all[i].pos) })
+	}
+	start = min(start, len(all))
+	end := min(start+lr.Count, len(all))
+
+	page := make([]Photo, 0, end-start)
+	for _, x := range all[start:end] {
+		page = append(page, x.p)
+	}
+	var next string
+	if end < len(all) {
+		next = encodeCursor(kind, all[end-1].pos)
+	}
+	return page, next, nil
+}
@@ -0,0 +1,145 @@
+package photos
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pzl/phumpkin/pkg/geo"
+	"github.com/saracen/walker"
+)
+
+type GeotagReq struct {
+	GPX       string        `json:"gpx"`       // local GPX file, absolute path
+	Dir       string        `json:"dir"`       // photoDir-relative
+	Recursive bool          `json:"recursive"` // include subdirectories of Dir
+	Offset    time.Duration `json:"offset"`    // added to camera time to get UTC
+	MaxGap    time.Duration `json:"max_gap"`   // largest track gap to interpolate over
+	Write     bool          `json:"write"`     // false previews the matches only
+	Overwrite bool          `json:"overwrite"` // replace existing locations
+}
+
+type GeotagMatch struct {
+	File    string    `json:"file"`
+	Taken   time.Time `json:"taken"` // UTC, after offset
+	Lat     float64   `json:"lat,omitempty"`
+	Lon     float64   `json:"lon,omitempty"`
+	Alt     *float64  `json:"alt,omitempty"`
+	Matched bool      `json:"matched"`
+	Written bool      `json:"written"`
+	Reason  string    `json:"reason,omitempty"` // why not matched or written
+}
+
+const DefaultMaxGap = 5 * time.Minute
+
+// match the photos in a directory against a GPS track by capture time.
+// When requested, matched positions are written to the XMP sidecars and re-indexed
+func (m *Mgr) Geotag(ctx context.Context, req GeotagReq) ([]GeotagMatch, error) {
+	photoDir := ctx.Value("photoDir").(string)
+	if req.MaxGap <= 0 {
+		req.MaxGap = DefaultMaxGap
+	}
+
+	track, err := geo.ReadGPX(req.GPX)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(photoDir, path.Clean("/"+req.Dir))
+	files := make([]string, 0, 100)
+	err = walker.WalkWithContext(ctx, dir, func(name string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			if name == dir || (req.Recursive && !m.indexer.skips(strings.TrimPrefix(name, photoDir+"/"), true)) {
+				return nil
+			}
+			return filepath.SkipDir
+		}
+		if m.indexer.skips(strings.TrimPrefix(name, photoDir+"/"), false) {
+			return nil
+		}
+		files = append(files, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	matches := make([]GeotagMatch, 0, len(files))
+	for _, f := range files {
+		p, err := FromSrc(ctx, f)
+		if err != nil {
+			continue
+		}
+		gm := GeotagMatch{File: p.Relpath()}
+
+		taken, err := p.Taken()
+		if err != nil {
+			gm.Reason = err.Error()
+			matches = append(matches, gm)
+			continue
+		}
+		gm.Taken = taken.Add(req.Offset)
+
+		tp, ok := track.At(gm.Taken, req.MaxGap)
+		if !ok {
+			gm.Reason = "no track position within max gap"
+			matches = append(matches, gm)
+			continue
+		}
+		gm.Matched = true
+		gm.Lat = tp.Lat
+		gm.Lon = tp.Lon
+		if tp.HasEle {
+			ele := tp.Ele
+			gm.Alt = &ele
+		}
+
+		if req.Write {
+			if l, err := p.Meta("Location"); err == nil && l != nil && !req.Overwrite {
+				gm.Reason = "already has a location"
+			} else if err := WriteXMPLocation(p.Src+".xmp", gm.Lat, gm.Lon, gm.Alt); err != nil {
+				gm.Reason = err.Error()
+			} else {
+				gm.Written = true
+				m.indexer.Index(gm.File, false)
+			}
+		}
+		matches = append(matches, gm)
+	}
+
+	return matches, nil
+}
+
+// capture time, from the camera's clock. Since cameras don't record
+// a zone, this is returned as if it were UTC
+func (p *Photo) Taken() (time.Time, error) {
+	dto := p.MetaString("DateTimeOriginal")
+	if dto == "" {
+		return time.Time{}, errors.New("no DateTimeOriginal")
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", dto)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ss, err := p.Meta("SubSecTimeOriginal"); err == nil && ss != nil {
+		// exiftool turns digit-only values into numbers
+		var frac string
+		switch v := ss.(type) {
+		case string:
+			frac = v
+		case float64:
+			frac = strconv.Itoa(int(v))
+		}
+		if d, err := time.ParseDuration("0." + frac + "s"); err == nil {
+			t = t.Add(d)
+		}
+	}
+	return t, nil
+}
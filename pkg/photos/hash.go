@@ -0,0 +1,167 @@
+package photos
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+	Content hashes, for finding byte-identical copies of a photo.
+
+	key: primaryRecord + SourceEXIF + HashRecord + file
+	value: JSON fileHash
+
+	Files are hashed while their EXIF is indexed, and the hash is also
+	indexed as the EXIF field sha256, so copies are one prefix scan away.
+	Empty files, and files larger than hashMaxSize, are left out. A file
+	the same size and modification time as when it was last hashed isn't
+	read again.
+*/
+
+const hashMaxSize = 2 << 30
+
+type fileHash struct {
+	Sum     string `json:"sha256"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // unix ns
+}
+
+func HashKey(file string) []byte {
+	return append([]byte{primaryRecord, SourceEXIF, HashRecord}, []byte(file)...)
+}
+
+// content hash of a file, reusing the stored one if the file hasn't changed.
+// false for files that aren't hashed, empty or too large
+func (idx *Indexer) hashFile(file string) (fileHash, bool, error) {
+	fullpath := filepath.Join(idx.photoDir, file)
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return fileHash{}, false, err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() == 0 || fi.Size() > hashMaxSize {
+		return fileHash{}, false, nil
+	}
+
+	var h fileHash
+	err = idx.db.View(func(tx *badger.Txn) error {
+		v, err := getValue(tx, HashKey(file))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(v, &h)
+	})
+	if err == nil && h.Size == fi.Size() && h.ModTime == fi.ModTime().UnixNano() {
+		return h, true, nil
+	}
+
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return fileHash{}, false, err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	n, err := io.Copy(sum, f)
+	if err != nil {
+		return fileHash{}, false, err
+	}
+	return fileHash{
+		Sum:     hex.EncodeToString(sum.Sum(nil)),
+		Size:    n,
+		ModTime: fi.ModTime().UnixNano(),
+	}, true, nil
+}
+
+func (idx *Indexer) writeHash(file string, h fileHash) error {
+	v, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return idx.update(func(tx *badger.Txn) error {
+		return tx.Set(HashKey(file), v)
+	})
+}
+
+type Duplicate struct {
+	File     string   `json:"file"`
+	Sidecars []string `json:"sidecars"`
+}
+
+// byte-identical files
+type DuplicateGroup struct {
+	Sum    string      `json:"sha256"`
+	Size   int64       `json:"size"`
+	Wasted int64       `json:"wasted"` // bytes taken by all but one copy
+	Files  []Duplicate `json:"files"`
+}
+
+// every set of files with the same content, most wasted space first.
+// Paths are photoDir-relative
+func Duplicates(ctx context.Context) ([]DuplicateGroup, error) {
+	db := ctx.Value("badger").(*badger.DB)
+	photoDir := ctx.Value("photoDir").(string)
+
+	bySum := make(map[string][]string)
+	groups := make([]DuplicateGroup, 0, 20)
+	err := db.View(func(tx *badger.Txn) error {
+		scanIdx(tx, idxValuePrefix(SourceEXIF, "sha256", ""), func(e idxEntry) {
+			bySum[e.Value] = append(bySum[e.Value], e.File)
+		})
+		for sum, files := range bySum {
+			if len(files) < 2 {
+				continue
+			}
+			g := DuplicateGroup{Sum: sum, Files: make([]Duplicate, 0, len(files))}
+			if v, err := getValue(tx, HashKey(files[0])); err == nil {
+				var h fileHash
+				if json.Unmarshal(v, &h) == nil {
+					g.Size = h.Size
+				}
+			}
+			g.Wasted = g.Size * int64(len(files)-1)
+			sort.Strings(files)
+			for _, f := range files {
+				g.Files = append(g.Files, Duplicate{File: f, Sidecars: sidecars(photoDir, f)})
+			}
+			groups = append(groups, g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted {
+			return groups[i].Wasted > groups[j].Wasted
+		}
+		return groups[i].Files[0].File < groups[j].Files[0].File
+	})
+	return groups, nil
+}
+
+// darktable sidecars of a file: <IMG>.ARW.xmp, and <IMG>_nn.ARW.xmp for
+// its duplicates
+func sidecars(photoDir string, file string) []string {
+	full := filepath.Join(photoDir, file)
+	found := make([]string, 0, 1)
+	if _, err := os.Stat(full + ".xmp"); err == nil {
+		found = append(found, file+".xmp")
+	}
+	ext := filepath.Ext(full)
+	dupes, _ := filepath.Glob(strings.TrimSuffix(full, ext) + "_[0-9][0-9]" + ext + ".xmp")
+	for _, d := range dupes {
+		if rel, err := filepath.Rel(photoDir, d); err == nil {
+			found = append(found, rel)
+		}
+	}
+	return found
+}
@@ -1,11 +1,11 @@
 package photos
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -14,21 +14,44 @@ import (
 
 	"github.com/dgraph-io/badger"
 	"github.com/fsnotify/fsnotify"
+	"github.com/pzl/phumpkin/pkg/formats"
+	"github.com/pzl/phumpkin/pkg/geo"
+	"github.com/pzl/phumpkin/pkg/ignore"
+	"github.com/pzl/phumpkin/pkg/orientation"
+	"github.com/pzl/phumpkin/pkg/watch"
 	"github.com/saracen/walker"
 	"github.com/sirupsen/logrus"
 )
 
 type Indexer struct {
-	photoDir string
-	watcher  *fsnotify.Watcher
-	ctx      context.Context
-	log      logrus.FieldLogger
-	db       *badger.DB
+	photoDir     string
+	thumbDir     string // for cached previews, optional
+	dataDir      string // for staging restores, optional
+	watcher      watch.Watcher
+	watchMode    string        // watch.Auto, watch.Notify or watch.Poll
+	pollInterval time.Duration // for watch.Poll
+	ctx          context.Context
+	log          logrus.FieldLogger
+	db           *badger.DB
+	geocoder     *geo.Geocoder // optional
+	stackGap     time.Duration // 0 to not stack
+	prefer       string        // PreferRaw or PreferJPEG
+	stacks       stacker
+	moves        mover
+	rules        *ignore.Rules // .phumpkinignore files
+
+	reconciling sync.Mutex   // one reconcile pass at a time
+	pause       sync.RWMutex // writes hold it shared, restores whole
+	status      statusTracker
+	ready       chan struct{} // closed once the startup reconcile is done
 }
 
 // index files if necessary (write times checked)
 // relative path given
-func (idx *Indexer) Index(path string, recur bool) {
+func (idx *Indexer) Index(path string, recur bool) { idx.index(path, recur, false) }
+
+// forced indexing re-reads files even when up to date
+func (idx *Indexer) index(path string, recur bool, force bool) {
 	l := idx.log.WithField("path", path)
 	fullpath := filepath.Join(idx.photoDir, path)
 
@@ -38,9 +61,14 @@ func (idx *Indexer) Index(path string, recur bool) {
 		l.WithError(err).Error("unable to stat path")
 		return
 	}
+	if path != "" && idx.skips(path, fi.IsDir()) {
+		l.Trace("not a photo, or ignored. Not indexing")
+		return
+	}
 
 	if !fi.IsDir() {
-		if err := idx.indexFileIfNeeded(path, nil); err != nil {
+		idx.status.queue(1)
+		if _, err := idx.indexFileIfNeeded(path, force); err != nil {
 			l.WithError(err).Error("error indexing file")
 		}
 		return
@@ -53,23 +81,32 @@ func (idx *Indexer) Index(path string, recur bool) {
 
 	// if dir, do the business for each file
 	var wg sync.WaitGroup
-	batch := idx.db.NewWriteBatch()
 	err = walker.WalkWithContext(idx.ctx, fullpath, func(name string, fi os.FileInfo) error {
 		if fi.IsDir() {
+			if name != fullpath && idx.skips(idx.relpath(name), true) {
+				return filepath.SkipDir
+			}
 			if recur {
+				// list it, even before it has photos
+				if name != idx.photoDir {
+					if err := idx.update(func(tx *badger.Txn) error { return ensureDirs(tx, idx.relpath(name)) }); err != nil {
+						l.WithField("dir", name).WithError(err).Error("error adding directory to index")
+					}
+				}
 				return nil
 			} else {
 				return filepath.SkipDir
 			}
 		}
-		if strings.HasSuffix(name, ".xmp") {
+		if idx.skips(idx.relpath(name), false) {
 			return nil
 		}
 		filename := idx.relpath(name)
+		idx.status.queue(1)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := idx.indexFileIfNeeded(filename, batch); err != nil {
+			if _, err := idx.indexFileIfNeeded(filename, force); err != nil {
 				l.WithField("file", filename).WithError(err).Error("erroring indexing file in path")
 			}
 		}()
@@ -79,25 +116,55 @@ func (idx *Indexer) Index(path string, recur bool) {
 		l.WithError(err).Error("error when crawling path")
 	}
 	wg.Wait()
-	batch.Flush()
 }
 
-// writes file info to DB if either XMP or EXIF are out of date.
-// checks write times. expects relative path
-// batcher is optional db batchwriter. nil is acceptable
-func (idx *Indexer) indexFileIfNeeded(file string, batcher *badger.WriteBatch) error {
+// truncate to avoid using space
+func indexValue(s string) string {
+	if len(s) > 120 {
+		return s[:120]
+	}
+	return s
+}
+
+// writes file info to DB if either XMP or EXIF are out of date, or always when forced.
+// checks write times. expects relative path. Returns whether anything was read,
+// and counts the file towards indexing status
+func (idx *Indexer) indexFileIfNeeded(file string, force bool) (bool, error) {
 	xmp, exif, err := idx.needsIndex(file)
 	if err != nil {
-		return err
+		idx.status.fail(file, err)
+		return false, err
+	}
+	if force {
+		_, err := os.Stat(filepath.Join(idx.photoDir, file) + ".xmp")
+		xmp, exif = err == nil, true
 	}
-	return idx.indexFile(file, xmp, exif, batcher)
+	if !xmp && !exif {
+		idx.status.skip()
+		return false, nil
+	}
+	if err := idx.indexFile(file, xmp, exif); err != nil {
+		idx.status.fail(file, err)
+		return true, err
+	}
+	idx.status.done()
+	return true, nil
 }
 
-// indexes a file. expects relative path
-func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.WriteBatch) error {
+// indexes a file. expects relative path. Errors are logged, and the first returned
+func (idx *Indexer) indexFile(file string, xmp bool, exif bool) error {
 	l := idx.log.WithField("file", file)
 	fullpath := filepath.Join(idx.photoDir, file)
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var ferr error
+	fail := func(err error) {
+		mu.Lock()
+		if ferr == nil {
+			ferr = err
+		}
+		mu.Unlock()
+	}
 	if xmp {
 		wg.Add(1)
 		go func() {
@@ -105,11 +172,9 @@ func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.
 			defer wg.Done()
 			if x, err := ReadXMPFile(fullpath + ".xmp"); err != nil {
 				l.WithError(err).Error("error reading XMP file")
+				fail(err)
 			} else {
 				l.Debug("indexing XMP data")
-				if err := Write(idx.ctx, SourceXMP, file, x, batcher); err != nil {
-					l.WithError(err).Error("error writing XMP to db")
-				}
 				toIndex := [][2]string{
 					[2]string{"derived_from", x.DerivedFromFile},
 					[2]string{"rating", strconv.Itoa(x.Rating)},
@@ -118,11 +183,10 @@ func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.
 					[2]string{"creator", x.Creator},
 					[2]string{"rights", x.Rights},
 					[2]string{"title", x.Title},
+					[2]string{"description", x.Description},
 				}
 				if x.Location != nil {
-					toIndex = append(toIndex, [2]string{"loc.lat", x.Location.Lat})
-					toIndex = append(toIndex, [2]string{"loc.lon", x.Location.Lon})
-					toIndex = append(toIndex, [2]string{"loc.alt", x.Location.Altitude})
+					toIndex = append(toIndex, idx.locationFields(*x.Location)...)
 				}
 				for _, c := range x.ColorLabels {
 					toIndex = append(toIndex, [2]string{"color_labels", c})
@@ -137,13 +201,9 @@ func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.
 					toIndex = append(toIndex, [2]string{"history", h.OpName})
 				}
 
-				for _, ti := range toIndex {
-					if ti[1] == "" {
-						continue // skip blank values
-					}
-					if err := WriteIdxField(idx.ctx, SourceXMP, file, ti[0], []byte(ti[1]), batcher); err != nil {
-						l.WithError(err).WithField("field", ti[0]).WithField("value", ti[1]).Error("error writing XMP field to index")
-					}
+				if err := idx.writeSource(SourceXMP, file, x, toIndex); err != nil {
+					l.WithError(err).Error("error writing XMP to db")
+					fail(err)
 				}
 			}
 		}()
@@ -155,11 +215,10 @@ func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.
 			defer wg.Done()
 			if data, err := ReadExifFile(fullpath); err != nil {
 				l.WithError(err).Error("error reading exif")
+				fail(err)
 			} else {
 				l.Debug("indexing EXIF data")
-				if err := Write(idx.ctx, SourceEXIF, file, data, batcher); err != nil {
-					l.WithError(err).Error("error writing exif to db")
-				}
+				toIndex := make([][2]string, 0, len(data))
 				for k, v := range data {
 					var s string
 					switch tv := v.(type) {
@@ -176,15 +235,33 @@ func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.
 					default:
 						s = fmt.Sprintf("unhandled :: %T", v)
 					}
-					if s == "(none)" || s == "" || s == "n/a" {
+					if s == "(none)" || s == "n/a" {
 						continue
 					}
-					// truncate to avoid using space
-					if len(s) > 120 {
-						s = s[:120]
-					}
-					if err := WriteIdxField(idx.ctx, SourceEXIF, file, k, []byte(s), batcher); err != nil {
-						l.WithError(err).WithField("field", k).WithField("value", s).Error("error writing EXIF field to index")
+					toIndex = append(toIndex, [2]string{k, indexValue(s)})
+				}
+				if _, has := data["GPSLatitude"]; has {
+					toIndex = append(toIndex, idx.locationFields(exifLocation(data))...)
+				}
+				if ph, err := idx.perceptualHash(file, orientation.FromValue(data["Orientation"])); err != nil {
+					l.WithError(err).Debug("unable to take perceptual hash")
+				} else {
+					toIndex = append(toIndex, [2]string{phashField, formatPHash(ph)})
+				}
+				h, hashed, err := idx.hashFile(file)
+				if err != nil {
+					l.WithError(err).Error("error hashing file")
+				} else if hashed {
+					toIndex = append(toIndex, [2]string{"sha256", h.Sum})
+				}
+
+				if err := idx.writeSource(SourceEXIF, file, data, toIndex); err != nil {
+					l.WithError(err).Error("error writing exif to db")
+					fail(err)
+				} else if hashed {
+					if err := idx.writeHash(file, h); err != nil {
+						l.WithError(err).Error("error writing file hash to db")
+						fail(err)
 					}
 				}
 			}
@@ -192,7 +269,99 @@ func (idx *Indexer) indexFile(file string, xmp bool, exif bool, batcher *badger.
 	}
 
 	wg.Wait()
-	return nil
+	return ferr
+}
+
+// replace everything stored for one source of a file in a single transaction:
+// the data record, its write time, the index and text entries, and the list of
+// those entries so they can be found again without a scan. Blank values are skipped
+func (idx *Indexer) writeSource(source byte, file string, data interface{}, fields [][2]string) error {
+	d, tm, err := marshalForWrite(data)
+	if err != nil {
+		return fmt.Errorf("unable to marshal data for file %s: %w", file, err)
+	}
+
+	keys := make([][]byte, 0, len(fields))
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		keys = append(keys, idxEntry{Source: source, Field: f[0], Value: f[1], File: file}.key())
+	}
+	keys = append(keys, phashEntries(file, fields)...)
+	weights := make(map[string]byte)
+	for w, wt := range textEntries(source, file, fields) {
+		k := textKey(w, file, source)
+		keys = append(keys, k)
+		weights[string(k)] = wt
+	}
+
+	var mtime int64
+	if source == SourceEXIF {
+		if fi, err := os.Stat(filepath.Join(idx.photoDir, file)); err == nil {
+			mtime = fi.ModTime().UnixNano()
+		}
+	}
+
+	err = idx.update(func(tx *badger.Txn) error {
+		if err := deleteIdxList(tx, file, source, keys); err != nil {
+			return err
+		}
+		if err := writeRecords(tx, d, tm, DataKey(file, source)); err != nil {
+			return err
+		}
+		if err := updateDirEntry(tx, file, func(e *dirEntry) {
+			e.set(source, fields)
+			if source == SourceEXIF {
+				e.ModTime = mtime
+			}
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			var v []byte
+			if wt, ok := weights[string(k)]; ok {
+				v = []byte{wt}
+			}
+			if err := tx.SetEntry(badger.NewEntry(k, v).WithDiscard()); err != nil {
+				return err
+			}
+		}
+		return tx.SetEntry(badger.NewEntry(IdxListKey(file, source), encodeKeyList(keys)).WithDiscard())
+	})
+	if err == nil {
+		idx.stacks.mark(path.Dir(file))
+	}
+	return err
+}
+
+// index fields for a location. Decimal degrees and meters when they could be
+// parsed, with a geohash for spatial lookups and place names if a geocoder
+// is loaded. Falls back to the raw strings
+func (idx *Indexer) locationFields(loc Location) [][2]string {
+	if !loc.HasCoords() {
+		return [][2]string{
+			[2]string{"loc.lat", loc.Lat},
+			[2]string{"loc.lon", loc.Lon},
+			[2]string{"loc.alt", loc.Altitude},
+		}
+	}
+	f := [][2]string{
+		[2]string{"loc.lat", strconv.FormatFloat(loc.Latitude, 'f', 6, 64)},
+		[2]string{"loc.lon", strconv.FormatFloat(loc.Longitude, 'f', 6, 64)},
+		[2]string{"loc.geohash", loc.Geohash()},
+	}
+	if loc.Altitude != "" {
+		f = append(f, [2]string{"loc.alt", strconv.FormatFloat(loc.AltMeters, 'f', 1, 64)})
+	}
+	if place, ok := idx.geocoder.Lookup(loc.Latitude, loc.Longitude); ok {
+		f = append(f,
+			[2]string{"loc.country", place.Country},
+			[2]string{"loc.region", place.Region},
+			[2]string{"loc.city", place.City},
+		)
+	}
+	return f
 }
 
 // whether (xmp, exif) need to be reindexed for being out-of-date or missing in DB
@@ -274,58 +443,89 @@ func (idx *Indexer) needsIndex(file string) (bool, bool, error) {
 	return xmp.needIndex, exif.needIndex, nil
 }
 
-// relative path needed
+// relative path needed. Directories are dropped with everything in them
 func (idx *Indexer) dropIndex(file string) error {
 	idx.log.WithField("path", file).Debug("dropping index")
-	key := DataKey(file, SourceXMP)
-
-	del := [][2]byte{
-		[2]byte{SourceEXIF, DataRecord},
-		[2]byte{SourceEXIF, TimestampRecord},
-		[2]byte{SourceXMP, DataRecord},
-		[2]byte{SourceXMP, TimestampRecord},
-	}
-
-	return idx.db.Update(func(tx *badger.Txn) error {
-		for _, t := range del {
-			nk := make([]byte, len(key))
-			copy(nk, key)
-			copy(nk[1:], t[:])
-			if err := tx.Delete(nk); err != nil {
-				idx.log.WithError(err).Error("error deleting index")
-			}
+
+	err := idx.update(func(tx *badger.Txn) error {
+		return dropRecords(tx, file, SourceEXIF, SourceXMP)
+	})
+	if err != nil {
+		return err
+	}
+	idx.stacks.mark(path.Dir(file))
+
+	// was it a directory?
+	var isDir bool
+	var files, dirs []string
+	err = idx.db.View(func(tx *badger.Txn) error {
+		if _, err := tx.Get(dirKey(file, dirSub)); err == nil {
+			isDir = true
+		} else if err != badger.ErrKeyNotFound {
+			return err
 		}
+		files, dirs = dirTree(tx, file)
+		return nil
+	})
+	if err != nil || file == "" || (!isDir && len(files) == 0 && len(dirs) == 0) {
+		return err
+	}
 
-		pfx := []byte{indexRecord}
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		opts.Prefix = pfx
-		fk := []byte(file)
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		idx.log.WithField("path", file).WithField("filekey", string(fk)).Trace("deleting search indexes")
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().KeyCopy(nil) // https://github.com/dgraph-io/badger/issues/494#issuecomment-390831885
-			if bytes.HasSuffix(k, fk) {
-				if err := tx.Delete(k); err != nil {
-					idx.log.WithError(err).WithField("k", string(k)).Error("error deleting query index")
-				}
+	drops := make(map[string][]byte, len(files))
+	for _, f := range files {
+		drops[f] = []byte{SourceEXIF, SourceXMP}
+	}
+	if failed := idx.dropBatched(drops); len(failed) > 0 {
+		return fmt.Errorf("unable to drop %d files under %s", len(failed), file)
+	}
+	return idx.update(func(tx *badger.Txn) error {
+		for _, d := range append(dirs, file) {
+			if err := tx.Delete(dirKey(d, dirSub)); err != nil {
+				return err
 			}
 		}
-
 		return nil
 	})
 }
 
+// deletes everything stored for the given sources of a file
+func dropRecords(tx *badger.Txn, file string, sources ...byte) error {
+	for _, src := range sources {
+		if err := deleteIdxList(tx, file, src, nil); err != nil {
+			return err
+		}
+		// the directory entry goes with the file, which is its EXIF
+		if src == SourceEXIF {
+			if err := deleteDirEntry(tx, file); err != nil {
+				return err
+			}
+		} else if _, err := tx.Get(dirKey(file, dirFile)); err == nil {
+			if err := updateDirEntry(tx, file, func(e *dirEntry) { e.set(src, nil) }); err != nil {
+				return err
+			}
+		}
+		for _, k := range [][]byte{DataKey(file, src), TimeKey(file, src), IdxListKey(file, src), HashKey(file)} {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (idx *Indexer) StartWatcher(ctx context.Context) error {
 	idx.ctx = ctx
-	w, err := fsnotify.NewWatcher()
+	w, mode, err := watch.New(idx.watchMode, idx.photoDir, idx.pollInterval)
 	if err != nil {
-		idx.log.WithError(err).Error("error creating fsnotify watcher")
+		idx.log.WithError(err).Error("error creating watcher")
 		return err
 	}
 	idx.watcher = w
+	l := idx.log.WithField("mode", mode)
+	if mode == watch.Poll {
+		l = l.WithField("interval", idx.pollInterval)
+	}
+	l.Info("watching photos")
 
 	idx.log.Debug("beginning indexer watch loop")
 	go func() {
@@ -334,30 +534,24 @@ func (idx *Indexer) StartWatcher(ctx context.Context) error {
 			idx.watcher = nil
 		}()
 
-		wdb := writeDebouncer(idx.Index, 1500*time.Millisecond)
+		deb := newDebouncer(debounceQuiet, debounceMax, func(p string) {
+			if path.Base(p) == ignore.File {
+				idx.rulesChanged()
+				return
+			}
+			idx.Index(p, true)
+		})
+		defer deb.stop()
 		for {
 			select {
-			case event := <-w.Events:
-				if !eventIs(event, fsnotify.Write) { // may get LOTS of write events per chunk, way too much for logging
-					idx.log.WithField("event", event).Trace("got watch event")
-				}
-				if eventIs(event, fsnotify.Remove) || eventIs(event, fsnotify.Rename) {
-					go idx.dropIndex(idx.relpath(event.Name)) // nolint
-				}
-				if eventIs(event, fsnotify.Create) || eventIs(event, fsnotify.Write) {
-					wdb <- idx.relpath(event.Name)
+			case event := <-w.Events():
+				idx.handle(event, deb)
+			case err := <-w.Errors():
+				if err == watch.ErrLimit {
+					idx.log.WithError(err).Warn("falling back to polling")
+					continue
 				}
-
-				// if a directory is added, we should add it
-				if eventIs(event, fsnotify.Create) {
-					if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
-						if err := idx.Watch(event.Name); err != nil {
-							idx.log.WithError(err).WithField("name", event.Name).Error("error watching directory")
-						}
-					}
-				}
-			case err := <-w.Errors:
-				idx.log.WithError(err).Error("got fsnotify error")
+				idx.log.WithError(err).Error("got watch error")
 			case <-ctx.Done():
 				idx.log.Info("context canceled. Exiting watcher loop")
 				return
@@ -367,29 +561,6 @@ func (idx *Indexer) StartWatcher(ctx context.Context) error {
 	return nil
 }
 
-func writeDebouncer(idx func(string, bool), timeout time.Duration) chan string {
-	incoming := make(chan string)
-
-	go func() {
-		var s string
-		t := time.NewTimer(timeout)
-		t.Stop()
-
-		for {
-			select {
-			case s = <-incoming:
-				t.Stop()
-				t.Reset(timeout)
-			case <-t.C:
-				go idx(s, true)
-			}
-		}
-	}()
-
-	return incoming
-
-}
-
 // *ABSOLUTE* path expected
 func (idx *Indexer) Watch(dir string) error {
 	l := idx.log.WithField("path", dir)
@@ -400,6 +571,9 @@ func (idx *Indexer) Watch(dir string) error {
 	l.Debug("indexer requested to watch path")
 	return walker.WalkWithContext(idx.ctx, dir, func(name string, fi os.FileInfo) error {
 		if fi.IsDir() {
+			if name != idx.photoDir && idx.skips(idx.relpath(name), true) {
+				return filepath.SkipDir
+			}
 			idx.log.WithField("path", name).Trace("watching path")
 			return idx.watcher.Add(name)
 		}
@@ -407,6 +581,47 @@ func (idx *Indexer) Watch(dir string) error {
 	})
 }
 
+// what to do about a watch event. Photos that changed wait in deb to be indexed
+func (idx *Indexer) handle(event fsnotify.Event, deb *debouncer) {
+	if !eventIs(event, fsnotify.Write) { // may get LOTS of write events per chunk, way too much for logging
+		idx.log.WithField("event", event).Trace("got watch event")
+	}
+	rel := idx.relpath(event.Name)
+	if path.Base(rel) == ignore.File {
+		idx.rules.Forget(path.Dir(rel))
+		deb.add(rel, false)
+		return
+	}
+	if eventIs(event, fsnotify.Remove) {
+		go idx.dropIndex(idx.relpath(event.Name)) // nolint
+	}
+	if eventIs(event, fsnotify.Rename) {
+		idx.renamed(idx.relpath(event.Name))
+	}
+	if eventIs(event, fsnotify.Create) {
+		go func(name string, full string) {
+			if idx.arrived(name) {
+				return
+			}
+			fi, err := os.Stat(full)
+			if dir := err == nil && fi.IsDir(); !idx.skips(photoOf(name), dir) {
+				deb.add(photoOf(name), dir)
+			}
+		}(idx.relpath(event.Name), event.Name)
+	} else if eventIs(event, fsnotify.Write) && !idx.skips(photoOf(rel), false) {
+		deb.add(photoOf(rel), false)
+	}
+
+	// if a directory is added, we should add it
+	if eventIs(event, fsnotify.Create) {
+		if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() && !idx.skips(rel, true) {
+			if err := idx.Watch(event.Name); err != nil {
+				idx.log.WithError(err).WithField("name", event.Name).Error("error watching directory")
+			}
+		}
+	}
+}
+
 // *ABSOLUTE* path expected
 func (idx *Indexer) UnWatch(dir string) error {
 	if idx.watcher == nil {
@@ -415,5 +630,30 @@ func (idx *Indexer) UnWatch(dir string) error {
 	return idx.watcher.Remove(dir)
 }
 
-func (idx Indexer) relpath(p string) string        { return strings.TrimPrefix(p, idx.photoDir+"/") }
+// whether a photoDir-relative path is left out of the library: files that
+// aren't photos, and anything ignored
+func (idx *Indexer) skips(rel string, dir bool) bool {
+	if !dir && !formats.Supported(rel) {
+		return true
+	}
+	return idx.rules != nil && idx.rules.Ignored(rel, dir)
+}
+
+// an ignore file changed. Drop what's ignored now, index what isn't, and
+// watch directories that are no longer ignored
+func (idx *Indexer) rulesChanged() {
+	idx.log.Info("ignore rules changed, reconciling index")
+	if _, err := idx.reconcile(idx.ctx); err != nil {
+		idx.log.WithError(err).Error("unable to reconcile index after ignore rules changed")
+	}
+	if err := idx.Watch(idx.photoDir); err != nil {
+		idx.log.WithError(err).Error("unable to watch photos after ignore rules changed")
+	}
+}
+
+// the photo an XMP sidecar belongs to, for changes to it to reindex. Other
+// paths are their own
+func photoOf(p string) string { return strings.TrimSuffix(p, ".xmp") }
+
+func (idx *Indexer) relpath(p string) string       { return strings.TrimPrefix(p, idx.photoDir+"/") }
 func eventIs(e fsnotify.Event, o fsnotify.Op) bool { return e.Op&o == o }
@@ -0,0 +1,232 @@
+package photos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path"
+	"strings"
+)
+
+/*
+	Index key codec.
+
+	Each variable-length part of an index key is escaped and terminated,
+	so any byte may appear in a field, value or filename:
+
+		0x00      ->  0x00 0xFF
+		end       ->  0x00 0x01
+
+	This keeps the byte order of the unescaped strings, and an unterminated
+	part is a prefix of every longer part that starts with it. So prefix
+	scans over fields, and values within a field, still work.
+
+	All index keys should be built and read through here.
+*/
+
+const (
+	escByte = 0x00
+	escNull = 0xFF
+	escEnd  = 0x01
+)
+
+var errBadKey = errors.New("malformed index key")
+
+type idxEntry struct {
+	Source byte
+	Field  string
+	Value  string
+	File   string
+}
+
+func (e idxEntry) key() []byte {
+	k := make([]byte, 0, 2+len(e.Field)+len(e.Value)+len(e.File)+6)
+	k = append(k, indexRecord, e.Source)
+	k = appendPart(k, e.Field)
+	k = appendPart(k, e.Value)
+	return appendPart(k, e.File)
+}
+
+func parseIdxKey(k []byte) (idxEntry, error) {
+	if len(k) < 2 || k[0] != indexRecord {
+		return idxEntry{}, errBadKey
+	}
+	e := idxEntry{Source: k[1]}
+	var err error
+	rest := k[2:]
+	if e.Field, rest, err = readPart(rest); err != nil {
+		return idxEntry{}, err
+	}
+	if e.Value, rest, err = readPart(rest); err != nil {
+		return idxEntry{}, err
+	}
+	if e.File, rest, err = readPart(rest); err != nil {
+		return idxEntry{}, err
+	}
+	if len(rest) != 0 {
+		return idxEntry{}, errBadKey
+	}
+	return e, nil
+}
+
+// prefix of all fields starting with partial
+func idxFieldPrefix(source byte, partial string) []byte {
+	return appendEscaped([]byte{indexRecord, source}, partial)
+}
+
+// prefix of all values of field starting with partial
+func idxValuePrefix(source byte, field string, partial string) []byte {
+	return appendEscaped(appendPart([]byte{indexRecord, source}, field), partial)
+}
+
+// prefix of all files with this exact field and value
+func idxExactPrefix(source byte, field string, value string) []byte {
+	return appendPart(appendPart([]byte{indexRecord, source}, field), value)
+}
+
+// text index entry: a word, the file and source it's from
+func textKey(token string, file string, source byte) []byte {
+	k := make([]byte, 0, 1+len(token)+len(file)+5)
+	k = append(k, textRecord)
+	k = appendPart(k, token)
+	k = appendPart(k, file)
+	return append(k, source)
+}
+
+func parseTextKey(k []byte) (token string, file string, err error) {
+	if len(k) < 1 || k[0] != textRecord {
+		return "", "", errBadKey
+	}
+	rest := k[1:]
+	if token, rest, err = readPart(rest); err != nil {
+		return "", "", err
+	}
+	if file, rest, err = readPart(rest); err != nil {
+		return "", "", err
+	}
+	if len(rest) != 1 {
+		return "", "", errBadKey
+	}
+	return token, file, nil
+}
+
+// prefix of all words starting with partial
+func textPrefix(partial string) []byte {
+	return appendEscaped([]byte{textRecord}, partial)
+}
+
+const (
+	dirFile byte = 'f'
+	dirSub  byte = 'd'
+)
+
+// directory entry for a file or subdirectory, under its parent
+func dirKey(p string, kind byte) []byte {
+	dir, name := splitPath(p)
+	k := make([]byte, 0, 1+len(p)+5)
+	k = append(appendPart(append(k, dirRecord), dir), kind)
+	return appendPart(k, name)
+}
+
+// prefix of a directory's files, or subdirectories
+func dirPrefix(dir string, kind byte) []byte {
+	return append(appendPart([]byte{dirRecord}, dir), kind)
+}
+
+// returns the path of the entry
+func parseDirKey(k []byte) (string, byte, error) {
+	if len(k) < 1 || k[0] != dirRecord {
+		return "", 0, errBadKey
+	}
+	dir, rest, err := readPart(k[1:])
+	if err != nil || len(rest) < 1 {
+		return "", 0, errBadKey
+	}
+	kind := rest[0]
+	name, rest, err := readPart(rest[1:])
+	if err != nil || len(rest) != 0 {
+		return "", 0, errBadKey
+	}
+	return path.Join(dir, name), kind, nil
+}
+
+// parent directory and name. The root directory is ""
+func splitPath(p string) (string, string) {
+	dir, name := path.Split(p)
+	return strings.TrimSuffix(dir, "/"), name
+}
+
+// sorted position of a file in its directory
+func sortKey(kind byte, file string, value string) []byte {
+	dir, name := splitPath(file)
+	k := make([]byte, 0, 2+len(file)+len(value)+6)
+	k = appendPart(append(k, sortRecord, kind), dir)
+	k = appendPart(k, value)
+	return appendPart(k, name)
+}
+
+// prefix of a directory's files in one sort order
+func sortPrefix(kind byte, dir string) []byte {
+	return appendPart([]byte{sortRecord, kind}, dir)
+}
+
+// a perceptual hash filed under one of its 16 bit chunks
+func phashKey(chunk int, h uint64, file string) []byte {
+	k := make([]byte, 12, 12+len(file))
+	copy(k, phashPrefix(chunk, phashChunk(h, chunk)))
+	binary.BigEndian.PutUint64(k[4:], h)
+	return append(k, file...)
+}
+
+// chunks are numbered from the high bits
+func phashChunk(h uint64, chunk int) uint16 { return uint16(h >> uint(48-16*chunk)) }
+
+// hashes with a given value for one chunk
+func phashPrefix(chunk int, v uint16) []byte {
+	return []byte{phashRecord, byte(chunk), byte(v >> 8), byte(v)}
+}
+
+func parsePHashKey(k []byte) (uint64, string, error) {
+	if len(k) < 12 || k[0] != phashRecord {
+		return 0, "", errBadKey
+	}
+	return binary.BigEndian.Uint64(k[4:12]), string(k[12:]), nil
+}
+
+// escaped and terminated
+func appendPart(b []byte, s string) []byte {
+	return append(appendEscaped(b, s), escByte, escEnd)
+}
+
+func appendEscaped(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == escByte {
+			b = append(b, escNull)
+		}
+	}
+	return b
+}
+
+// read one terminated part off the front of b, returning the remainder
+func readPart(b []byte) (string, []byte, error) {
+	var out []byte
+	for {
+		i := bytes.IndexByte(b, escByte)
+		if i == -1 || i+1 >= len(b) {
+			return "", nil, errBadKey
+		}
+		switch b[i+1] {
+		case escEnd:
+			if out == nil {
+				return string(b[:i]), b[i+2:], nil
+			}
+			return string(append(out, b[:i]...)), b[i+2:], nil
+		case escNull:
+			out = append(out, b[:i+1]...)
+			b = b[i+2:]
+		default:
+			return "", nil, errBadKey
+		}
+	}
+}
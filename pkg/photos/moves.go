@@ -0,0 +1,520 @@
+package photos
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pzl/phumpkin/pkg/formats"
+)
+
+/*
+	Moves and renames.
+
+	A rename is only the first half of a move: the watcher sees the old
+	name go, then a new one created. Renamed paths wait a moment for a
+	create to pair with before they're dropped. A new file pairs with a
+	pending rename with the same size and modification time in its stored
+	content hash, then with the same content, then with the same name.
+	A new directory pairs with a pending directory, the same name first.
+
+	Reconciling pairs files that went away with new ones the same way, by
+	content, since no events were seen.
+
+	A paired move rewrites every record of the old path under the new one,
+	index entries included, and moves its thumbnails, without reading the
+	file again.
+*/
+
+const moveWait = 2 * time.Second // how long a renamed path waits to be paired
+
+// renamed paths waiting to be paired with a create
+type mover struct {
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+// claim a pending rename. False if it isn't pending, or was dropped already
+func (mv *mover) claim(old string) bool {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	t, ok := mv.pending[old]
+	if !ok {
+		return false
+	}
+	delete(mv.pending, old)
+	return t.Stop()
+}
+
+func (mv *mover) list() []string {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	olds := make([]string, 0, len(mv.pending))
+	for o := range mv.pending {
+		olds = append(olds, o)
+	}
+	return olds
+}
+
+// a path was renamed away. Dropped unless a create pairs with it soon
+func (idx *Indexer) renamed(old string) {
+	if strings.HasSuffix(old, ".xmp") {
+		go idx.dropIndex(old) // nolint
+		return
+	}
+	idx.moves.mu.Lock()
+	defer idx.moves.mu.Unlock()
+	if idx.moves.pending == nil {
+		idx.moves.pending = make(map[string]*time.Timer)
+	}
+	if t, ok := idx.moves.pending[old]; ok {
+		t.Stop()
+	}
+	idx.moves.pending[old] = time.AfterFunc(moveWait, func() {
+		idx.moves.mu.Lock()
+		delete(idx.moves.pending, old)
+		idx.moves.mu.Unlock()
+		if err := idx.dropIndex(old); err != nil {
+			idx.log.WithError(err).WithField("path", old).Error("unable to drop renamed path")
+		}
+	})
+}
+
+// a path was created. Returns true if it was paired with a rename and moved,
+// and needs no indexing
+func (idx *Indexer) arrived(file string) bool {
+	if strings.HasSuffix(file, ".xmp") {
+		return false
+	}
+	olds := idx.moves.list()
+	if len(olds) == 0 {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(idx.photoDir, file))
+	if err != nil || idx.skips(file, fi.IsDir()) { // moved out of the library, as good as gone
+		return false
+	}
+	l := idx.log.WithField("path", file)
+
+	if fi.IsDir() {
+		var dirs []string
+		err := idx.db.View(func(tx *badger.Txn) error {
+			for _, o := range olds {
+				if _, err := tx.Get(dirKey(o, dirSub)); err == nil {
+					dirs = append(dirs, o)
+				}
+			}
+			return nil
+		})
+		if err != nil || len(dirs) == 0 {
+			return false
+		}
+		old := dirs[0]
+		for _, d := range dirs {
+			if path.Base(d) == path.Base(file) {
+				old = d
+			}
+		}
+		if len(dirs) > 1 && path.Base(old) != path.Base(file) {
+			return false // can't tell which
+		}
+		if !idx.moves.claim(old) {
+			return false
+		}
+		if err := idx.moveDir(old, file); err != nil {
+			l.WithError(err).WithField("from", old).Error("unable to move directory records")
+			go idx.dropIndex(old) // nolint
+			return false
+		}
+		return true
+	}
+
+	old := idx.pairFile(file, fi, olds)
+	if old == "" || !idx.moves.claim(old) {
+		return false
+	}
+	if err := idx.move(old, file); err != nil {
+		l.WithError(err).WithField("from", old).Error("unable to move records")
+		go idx.dropIndex(old) // nolint
+		return false
+	}
+	return true
+}
+
+// which of some gone files a new file is, if any
+func (idx *Indexer) pairFile(file string, fi os.FileInfo, olds []string) string {
+	hashes := make(map[string]fileHash)
+	err := idx.db.View(func(tx *badger.Txn) error {
+		for _, o := range olds {
+			if v, err := getValue(tx, HashKey(o)); err == nil {
+				var h fileHash
+				if json.Unmarshal(v, &h) == nil {
+					hashes[o] = h
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+
+	var stat, size []string
+	for o, h := range hashes {
+		if h.Size != fi.Size() {
+			continue
+		}
+		size = append(size, o)
+		if h.ModTime == fi.ModTime().UnixNano() {
+			stat = append(stat, o)
+		}
+	}
+	if len(stat) == 1 {
+		return stat[0]
+	}
+	if len(size) > 0 {
+		if h, ok, err := idx.hashFile(file); err == nil && ok {
+			for _, o := range size {
+				if hashes[o].Sum == h.Sum {
+					return o
+				}
+			}
+		}
+	}
+	// files without a stored hash, by name
+	for _, o := range olds {
+		if _, ok := hashes[o]; !ok && path.Base(o) == path.Base(file) {
+			return o
+		}
+	}
+	return ""
+}
+
+// move a file's records and thumbnails to a new path
+func (idx *Indexer) move(old string, file string) error {
+	idx.log.WithField("from", old).WithField("to", file).Debug("moving index")
+	if err := idx.update(func(tx *badger.Txn) error { return moveRecords(tx, old, file) }); err != nil {
+		return err
+	}
+	idx.moveThumbs(old, file, false)
+	idx.stacks.mark(path.Dir(old))
+	idx.stacks.mark(path.Dir(file))
+	return nil
+}
+
+// move the records and thumbnails of everything under a directory
+func (idx *Indexer) moveDir(old string, dir string) error {
+	idx.log.WithField("from", old).WithField("to", dir).Debug("moving directory index")
+	var files, dirs []string
+	err := idx.db.View(func(tx *badger.Txn) error {
+		files, dirs = dirTree(tx, old)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rebase := func(p string) string {
+		if p == old {
+			return dir
+		}
+		return path.Join(dir, strings.TrimPrefix(p, old+"/"))
+	}
+
+	for i := 0; i < len(files); i += reconcileBatch {
+		batch := files[i:min(i+reconcileBatch, len(files))]
+		err := idx.update(func(tx *badger.Txn) error {
+			for _, f := range batch {
+				if err := moveRecords(tx, f, rebase(f)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = idx.update(func(tx *badger.Txn) error {
+		for _, d := range append(dirs, old) {
+			if err := tx.Delete(dirKey(d, dirSub)); err != nil {
+				return err
+			}
+		}
+		for _, d := range append(dirs, old) {
+			if err := ensureDirs(tx, rebase(d)); err != nil {
+				return err
+			}
+		}
+		return ensureDirs(tx, dir)
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.moveThumbs(old, dir, true)
+	for _, d := range append(dirs, old) {
+		idx.stacks.mark(d)
+		idx.stacks.mark(rebase(d))
+	}
+	idx.stacks.mark(path.Dir(old))
+	return nil
+}
+
+// rewrite everything stored for a file under a new path. Words of the old
+// path are dropped from its text search entries, and EXIF's own note of
+// where the file is changed along
+func moveRecords(tx *badger.Txn, old string, file string) error {
+	exif, paths, err := movedEXIF(tx, old, file)
+	if err != nil {
+		return err
+	}
+
+	for _, src := range []byte{SourceEXIF, SourceXMP} {
+		v, err := getValue(tx, IdxListKey(old, src))
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		keys, err := decodeKeyList(v)
+		if err != nil {
+			return err
+		}
+		moved := make([][]byte, 0, len(keys))
+		var fields [][2]string
+		for _, k := range keys {
+			if len(k) > 0 && k[0] == textRecord { // found again from the fields, below
+				if err := tx.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+			nk, ok := rekey(k, file)
+			if !ok {
+				continue
+			}
+			if e, err := parseIdxKey(k); err == nil {
+				if p, ok := paths[e.Field]; ok && src == SourceEXIF {
+					e.Value, e.File = p, file
+					nk = e.key()
+				}
+				fields = append(fields, [2]string{e.Field, e.Value})
+			}
+			kv, err := getValue(tx, k)
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+			if err := tx.SetEntry(badger.NewEntry(nk, kv).WithDiscard()); err != nil {
+				return err
+			}
+			moved = append(moved, nk)
+		}
+		for w, wt := range textEntries(src, file, fields) {
+			k := textKey(w, file, src)
+			if err := tx.SetEntry(badger.NewEntry(k, []byte{wt}).WithDiscard()); err != nil {
+				return err
+			}
+			moved = append(moved, k)
+		}
+		if err := tx.Delete(IdxListKey(old, src)); err != nil {
+			return err
+		}
+		if err := tx.SetEntry(badger.NewEntry(IdxListKey(file, src), encodeKeyList(moved)).WithDiscard()); err != nil {
+			return err
+		}
+	}
+
+	if exif != nil {
+		if err := tx.Delete(DataKey(old, SourceEXIF)); err != nil {
+			return err
+		}
+		if err := tx.Set(DataKey(file, SourceEXIF), exif); err != nil {
+			return err
+		}
+	}
+	for _, kf := range []func(string) []byte{
+		func(f string) []byte { return TimeKey(f, SourceEXIF) },
+		func(f string) []byte { return DataKey(f, SourceXMP) },
+		func(f string) []byte { return TimeKey(f, SourceXMP) },
+		HashKey,
+	} {
+		v, err := getValue(tx, kf(old))
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := tx.Delete(kf(old)); err != nil {
+			return err
+		}
+		if err := tx.Set(kf(file), v); err != nil {
+			return err
+		}
+	}
+
+	e, err := getDirEntry(tx, old)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := deleteDirEntry(tx, old); err != nil {
+		return err
+	}
+	return updateDirEntry(tx, file, func(ne *dirEntry) {
+		*ne = e
+		ne.Stack, ne.Primary, ne.Siblings = nil, "", nil // found again by restacking
+	})
+}
+
+// an index key of a file, for another file
+func rekey(k []byte, file string) ([]byte, bool) {
+	if len(k) == 0 {
+		return nil, false
+	}
+	switch k[0] {
+	case indexRecord:
+		e, err := parseIdxKey(k)
+		if err != nil {
+			return nil, false
+		}
+		e.File = file
+		return e.key(), true
+	case phashRecord:
+		h, _, err := parsePHashKey(k)
+		if err != nil {
+			return nil, false
+		}
+		return phashKey(int(k[1]), h, file), true
+	}
+	return nil, false
+}
+
+// a file's EXIF record, with the path exiftool read it at changed to
+// where it moved. Also the changed fields, as indexed. Nil if it has none
+func movedEXIF(tx *badger.Txn, old string, file string) ([]byte, map[string]string, error) {
+	v, err := getValue(tx, DataKey(old, SourceEXIF))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var data map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(v))
+	dec.UseNumber() // as read, whatever their size
+	if err := dec.Decode(&data); err != nil {
+		return v, nil, nil // kept as it was
+	}
+
+	paths := map[string]string{"FileName": path.Base(file)}
+	if src, ok := data["SourceFile"].(string); ok && strings.HasSuffix(src, "/"+old) {
+		root := strings.TrimSuffix(src, "/"+old)
+		paths["SourceFile"] = path.Join(root, file)
+		paths["Directory"] = path.Dir(path.Join(root, file))
+	}
+	for k, p := range paths {
+		data[k] = p
+		paths[k] = indexValue(p)
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, paths, nil
+}
+
+// move generated thumbnails and previews of a file or directory. File
+// thumbnails are shared by siblings, and stay while one is left
+func (idx *Indexer) moveThumbs(old string, file string, dir bool) {
+	if idx.thumbDir == "" {
+		return
+	}
+	mv := func(from, to string) {
+		from, to = filepath.Join(idx.thumbDir, from), filepath.Join(idx.thumbDir, to)
+		if _, err := os.Stat(from); err != nil {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			idx.log.WithError(err).Warn("unable to make thumbnail directory")
+			return
+		}
+		if err := os.Rename(from, to); err != nil {
+			idx.log.WithError(err).WithField("from", from).Warn("unable to move thumbnail")
+		}
+	}
+	mv(filepath.Join("preview", old), filepath.Join("preview", file))
+
+	from, to := old, file
+	if !dir {
+		left, _ := filepath.Glob(filepath.Join(idx.photoDir, siblingBase(old)) + ".*")
+		for _, f := range left {
+			if formats.Supported(f) {
+				return
+			}
+		}
+		from, to = formats.ThumbName(old), formats.ThumbName(file)
+	}
+	for _, s := range []Size{SizeXS, SizeSmall, SizeMedium, SizeLarge, SizeXL, SizeFull} {
+		mv(filepath.Join(s.String(), from), filepath.Join(s.String(), to))
+	}
+}
+
+// pair files that went away with new ones by content, and move them.
+// Returns the new paths of what moved
+func (idx *Indexer) reconcileMoves(gone []string, files []string, indexed map[string]map[byte]bool) map[string]string {
+	bySize := make(map[int64][]string)
+	sums := make(map[string]string)
+	err := idx.db.View(func(tx *badger.Txn) error {
+		for _, o := range gone {
+			if v, err := getValue(tx, HashKey(o)); err == nil {
+				var h fileHash
+				if json.Unmarshal(v, &h) == nil {
+					bySize[h.Size] = append(bySize[h.Size], o)
+					sums[o] = h.Sum
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil || len(bySize) == 0 {
+		return nil
+	}
+
+	moved := make(map[string]string)
+	for _, f := range files {
+		if _, known := indexed[f]; known {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(idx.photoDir, f))
+		if err != nil || len(bySize[fi.Size()]) == 0 {
+			continue
+		}
+		h, ok, err := idx.hashFile(f)
+		if err != nil || !ok {
+			continue
+		}
+		cands := bySize[fi.Size()]
+		for i, o := range cands {
+			if sums[o] != h.Sum {
+				continue
+			}
+			if err := idx.move(o, f); err != nil {
+				idx.log.WithError(err).WithField("from", o).WithField("to", f).Error("unable to move records")
+				break
+			}
+			bySize[fi.Size()] = append(cands[:i:i], cands[i+1:]...)
+			moved[o] = f
+			break
+		}
+	}
+	return moved
+}
@@ -0,0 +1,95 @@
+package photos
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pzl/phumpkin/pkg/ignore"
+	"github.com/sirupsen/logrus"
+)
+
+// an indexer on a fresh database, and a context for queries. Close it when done
+func testIndexer(t *testing.T) (*Indexer, context.Context, func()) {
+	dir, err := ioutil.TempDir("", "phumpkin-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photoDir := filepath.Join(dir, "photos")
+	if err := os.Mkdir(photoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(dir, "db")).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	ctx := context.WithValue(context.Background(), "badger", db)
+	ctx = context.WithValue(ctx, "photoDir", photoDir)
+	idx := &Indexer{photoDir: photoDir, db: db, log: log, ctx: ctx, rules: ignore.New(photoDir)}
+	return idx, ctx, func() {
+		db.Close()
+		os.RemoveAll(dir) // nolint
+	}
+}
+
+func TestMoveRecords(t *testing.T) {
+	idx, ctx, done := testIndexer(t)
+	defer done()
+	exif := map[string]interface{}{
+		"SourceFile": "/lib/holiday/beach.jpg",
+		"FileName":   "beach.jpg",
+		"Directory":  "/lib/holiday",
+		"Make":       "Sony",
+	}
+	fields := [][2]string{}
+	for k, v := range exif {
+		fields = append(fields, [2]string{k, v.(string)})
+	}
+	if err := idx.writeSource(SourceEXIF, "holiday/beach.jpg", exif, fields); err != nil {
+		t.Fatal(err)
+	}
+	err := update(idx.db, func(tx *badger.Txn) error { return moveRecords(tx, "holiday/beach.jpg", "work/desk.jpg") })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for q, want := range map[string]int{"desk": 1, "work": 1, "sony": 1, "beach": 0, "holiday": 0} {
+		r, err := TextSearch(ctx, q, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Total != want {
+			t.Errorf("text search for %q found %d, want %d", q, r.Total, want)
+		}
+	}
+
+	var d map[string]interface{}
+	if err := Read(ctx, DataKey("work/desk.jpg", SourceEXIF), &d); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"SourceFile": "/lib/work/desk.jpg", "FileName": "desk.jpg", "Directory": "/lib/work", "Make": "Sony"}
+	for k, v := range want {
+		if d[k] != v {
+			t.Errorf("moved EXIF %s = %v, want %s", k, d[k], v)
+		}
+	}
+	err = idx.db.View(func(tx *badger.Txn) error {
+		for k, v := range want {
+			if _, err := tx.Get(idxEntry{Source: SourceEXIF, Field: k, Value: v, File: "work/desk.jpg"}.key()); err != nil {
+				t.Errorf("no index entry %s:%s for the moved file", k, v)
+			}
+		}
+		if _, err := tx.Get(idxEntry{Source: SourceEXIF, Field: "FileName", Value: "beach.jpg", File: "work/desk.jpg"}.key()); err == nil {
+			t.Errorf("old FileName still indexed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
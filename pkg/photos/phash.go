@@ -0,0 +1,271 @@
+package photos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg" // embedded previews
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/orientation"
+	"github.com/pzl/phumpkin/pkg/phash"
+	"github.com/pzl/phumpkin/pkg/preview"
+)
+
+/*
+	Similar photos, by perceptual hash (see pkg/phash).
+
+	Hashes are taken from the smallest embedded preview while indexing
+	EXIF, turned upright first, and indexed as the EXIF field phash.
+
+	To find hashes within a Hamming distance d without comparing against
+	all of them, each hash is also filed under each of its four 16 bit
+	chunks. Two hashes within d of each other have at least one chunk
+	within d/4 of each other, so a search looks up every chunk value that
+	close to the query's, and checks the full distance of what it finds.
+*/
+
+const (
+	phashField = "phash"
+	phashPx    = 160 // wanted preview size, anything this big hashes the same
+
+	DefaultSimilarity = 6  // bits of 64
+	MaxSimilarity     = 11 // keeps lookups at d/4 = 2 bits per chunk
+)
+
+var ErrNotHashed = errors.New("photo has no perceptual hash")
+
+// perceptual hash of a photo's preview
+func (idx *Indexer) perceptualHash(file string, o orientation.Orientation) (uint64, error) {
+	var cache string
+	if idx.thumbDir != "" {
+		cache = filepath.Join(idx.thumbDir, "preview", file)
+	}
+	b, err := preview.Small(filepath.Join(idx.photoDir, file), phashPx, cache)
+	if err != nil {
+		return 0, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	return phash.DHash(o.Apply(img)), nil
+}
+
+func formatPHash(h uint64) string { return fmt.Sprintf("%016x", h) }
+
+// lookup keys for the phash field of a file
+func phashEntries(file string, fields [][2]string) [][]byte {
+	for _, f := range fields {
+		if f[0] != phashField {
+			continue
+		}
+		h, err := strconv.ParseUint(f[1], 16, 64)
+		if err != nil {
+			return nil
+		}
+		keys := make([][]byte, 0, 4)
+		for c := 0; c < 4; c++ {
+			keys = append(keys, phashKey(c, h, file))
+		}
+		return keys
+	}
+	return nil
+}
+
+// stored hash of a file, from its EXIF index list
+func getPHash(tx *badger.Txn, file string) (uint64, bool, error) {
+	v, err := getValue(tx, IdxListKey(file, SourceEXIF))
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	keys, err := decodeKeyList(v)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, k := range keys {
+		if len(k) > 0 && k[0] == phashRecord {
+			h, _, err := parsePHashKey(k)
+			return h, err == nil, err
+		}
+	}
+	return 0, false, nil
+}
+
+// every 16 bit value within r bits of v
+func near16(v uint16, r int) []uint16 {
+	out := []uint16{v}
+	var flip func(from int, v uint16, left int)
+	flip = func(from int, v uint16, left int) {
+		for b := from; b < 16; b++ {
+			f := v ^ (1 << uint(b))
+			out = append(out, f)
+			if left > 1 {
+				flip(b+1, f, left-1)
+			}
+		}
+	}
+	if r > 0 {
+		flip(0, v, r)
+	}
+	return out
+}
+
+type SimilarPhoto struct {
+	Photo    Photo `json:"photo"`
+	Distance int   `json:"distance"`
+}
+
+// photos that look like file (photoDir-relative), closest first. Within
+// maxDist bits
+func Similar(ctx context.Context, file string, maxDist int) ([]SimilarPhoto, error) {
+	log := logger.LogFromCtx(ctx)
+	db := ctx.Value("badger").(*badger.DB)
+	photoDir := ctx.Value("photoDir").(string)
+	if maxDist < 0 || maxDist > MaxSimilarity {
+		return nil, fmt.Errorf("distance must be between 0 and %d", MaxSimilarity)
+	}
+	file = strings.TrimPrefix(path.Clean("/"+file), "/")
+
+	found := make(map[string]int)
+	err := db.View(func(tx *badger.Txn) error {
+		h, ok, err := getPHash(tx, file)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return badger.ErrKeyNotFound
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for c := 0; c < 4; c++ {
+			for _, v := range near16(phashChunk(h, c), maxDist/4) {
+				pfx := phashPrefix(c, v)
+				for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+					oh, of, err := parsePHashKey(it.Item().Key())
+					if err != nil || of == file {
+						continue
+					}
+					if d := phash.Distance(h, oh); d <= maxDist {
+						found[of] = d
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotHashed
+	} else if err != nil {
+		return nil, err
+	}
+
+	ps := make([]SimilarPhoto, 0, len(found))
+	for f, d := range found {
+		p, err := FromSrc(ctx, filepath.Join(photoDir, f))
+		if err != nil {
+			log.WithError(err).Error("error converting index result to photo")
+			continue
+		}
+		ps = append(ps, SimilarPhoto{p, d})
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Distance != ps[j].Distance {
+			return ps[i].Distance < ps[j].Distance
+		}
+		return ps[i].Photo.Src < ps[j].Photo.Src
+	})
+	return ps, nil
+}
+
+// groups of photos in a directory (not below it) that look alike. Photos
+// are in a group if they're within maxDist of any other in it
+func SimilarClusters(ctx context.Context, dir string, maxDist int) ([][]string, error) {
+	db := ctx.Value("badger").(*badger.DB)
+	if maxDist < 0 || maxDist > MaxSimilarity {
+		return nil, fmt.Errorf("distance must be between 0 and %d", MaxSimilarity)
+	}
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+
+	var files []string
+	var hashes []uint64
+	err := db.View(func(tx *badger.Txn) error {
+		pfx := dirPrefix(dir, dirFile)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			f, _, err := parseDirKey(it.Item().Key())
+			if err != nil {
+				continue
+			}
+			h, ok, err := getPHash(tx, f)
+			if err != nil {
+				return err
+			}
+			if ok {
+				files = append(files, f)
+				hashes = append(hashes, h)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// union-find over every close pair. A folder is small enough to compare all
+	parent := make([]int, len(files))
+	for i := range parent {
+		parent[i] = i
+	}
+	root := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if phash.Distance(hashes[i], hashes[j]) <= maxDist {
+				parent[root(i)] = root(j)
+			}
+		}
+	}
+
+	groups := make(map[int][]string)
+	for i, f := range files {
+		r := root(i)
+		groups[r] = append(groups[r], f)
+	}
+	clusters := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		if len(g) > 1 {
+			sort.Strings(g)
+			clusters = append(clusters, g)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters, nil
+}
@@ -13,6 +13,9 @@ import (
 
 	"github.com/dgraph-io/badger"
 	"github.com/pzl/phumpkin/pkg/darktable"
+	"github.com/pzl/phumpkin/pkg/formats"
+	"github.com/pzl/phumpkin/pkg/geo"
+	"github.com/pzl/phumpkin/pkg/orientation"
 )
 
 type Size int
@@ -86,14 +89,67 @@ type XMP struct {
 	Rights          string         `json:"rights"`
 	Tags            []string       `json:"tags,omitempty"`
 	Title           string         `json:"title,omitempty"`
+	Description     string         `json:"description,omitempty"`
 }
 
 type Location struct {
 	Lat      string `json:"lat"`
 	Lon      string `json:"lon"`
 	Altitude string `json:"alt"`
+
+	// parsed forms of the above. Signed decimal degrees, and meters
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	AltMeters float64 `json:"alt_m"`
+	Coords    bool    `json:"coords"` // whether Latitude and Longitude parsed. 0,0 is a place
+}
+
+// build a location from the metadata strings, parsing what we can
+func NewLocation(lat string, lon string, alt string, altRef string) Location {
+	l := Location{
+		Lat:      lat,
+		Lon:      lon,
+		Altitude: alt,
+	}
+	la, laErr := geo.ParseCoord(lat)
+	lo, loErr := geo.ParseCoord(lon)
+	if laErr == nil && loErr == nil {
+		l.Latitude = la
+		l.Longitude = lo
+		l.Coords = true
+	}
+	if a, err := geo.ParseAltitude(alt, altRef); err == nil {
+		l.AltMeters = a
+	}
+	return l
+}
+
+// whether decimal coordinates could be parsed
+func (l Location) HasCoords() bool { return l.Coords }
+
+// locations stored before Coords was kept are parsed again
+func (l *Location) UnmarshalJSON(b []byte) error {
+	type plain Location
+	var v struct {
+		plain
+		Coords *bool `json:"coords"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*l = Location(v.plain)
+	if v.Coords != nil {
+		l.Coords = *v.Coords
+	} else {
+		_, laErr := geo.ParseCoord(l.Lat)
+		_, loErr := geo.ParseCoord(l.Lon)
+		l.Coords = laErr == nil && loErr == nil
+	}
+	return nil
 }
 
+func (l Location) Geohash() string { return geo.Encode(l.Latitude, l.Longitude, geo.Precision) }
+
 /*
 	data to track:
 		- source file (jpg, raw)
@@ -244,6 +300,8 @@ func (p *Photo) Meta(field string) (interface{}, error) {
 			return x.Tags, xload_err
 		case "Title":
 			return x.Title, xload_err
+		case "Description":
+			return x.Description, xload_err
 
 		// the below cases can be backfilled from Exif data
 		case "Location":
@@ -277,26 +335,14 @@ func (p *Photo) Meta(field string) (interface{}, error) {
 	if field == "Location" {
 		// special handling to remake the struct expected
 
-		lat, has := ex["GPSLatitude"]
-		if !has {
+		if _, has := ex["GPSLatitude"]; !has {
 			return nil, nil
 		}
-		lon, has := ex["GPSLongitude"]
-		if !has {
+		if _, has := ex["GPSLongitude"]; !has {
 			return nil, nil
 		}
 
-		var alt string
-		a, has := ex["GPSAltitude"]
-		if has {
-			alt = a.(string)
-		}
-
-		return Location{
-			Lat:      lat.(string),
-			Lon:      lon.(string),
-			Altitude: alt,
-		}, nil
+		return exifLocation(ex), nil
 	}
 
 	v, has := ex[field]
@@ -308,6 +354,20 @@ func (p *Photo) Meta(field string) (interface{}, error) {
 	return v, nil
 }
 
+// location from exiftool GPS fields. Check for GPSLatitude before calling
+func exifLocation(ex map[string]interface{}) Location {
+	str := func(k string) string {
+		switch v := ex[k].(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return ""
+	}
+	return NewLocation(str("GPSLatitude"), str("GPSLongitude"), str("GPSAltitude"), "")
+}
+
 // retrieve a meta value as a string, swallowing errors and returning empty string
 // if not exists, or error
 func (p *Photo) MetaString(field string) string {
@@ -404,12 +464,11 @@ func (p Photo) Relpath() string {
 	return strings.TrimPrefix(p.Src, photoDir+"/")
 }
 
-func (p *Photo) Orientation() Orientation {
-	o := OrientationInvalid
-	p.Ex_if_string("Orientation", func(s string) {
-		o = parseOrientation(s)
-	})
-	return o
+func (p *Photo) Orientation() orientation.Orientation {
+	if !p.exifRead {
+		p.loadExif() // @todo: surface this
+	}
+	return orientation.FromValue(p.exif["Orientation"])
 }
 
 // rotation convenience function
@@ -428,52 +487,12 @@ func (r RotMode) String() string {
 }
 
 func (p Photo) Rotation() RotMode {
-	if p.Orientation() > Rot180 {
+	if p.Orientation().SwapsDimensions() {
 		return Portrait
 	}
 	return Landscape
 }
 
-/*  EXIF rotation values */
-
-type Orientation int
-
-// rotations are specified in a clockwise direction
-// https://www.daveperrett.com/articles/2012/07/28/exif-orientation-handling-is-a-ghetto/
-const (
-	OrientationInvalid Orientation = -1
-	RotNormal          Orientation = 0
-	MirrorVert         Orientation = 1
-	MirrorHoriz        Orientation = 2
-	Rot180             Orientation = 3
-	MirrorHorizRot270  Orientation = 4
-	Rot90              Orientation = 5
-	Rot270             Orientation = 6
-	MirrorHorizRot90   Orientation = 7
-)
-
-func parseOrientation(s string) Orientation {
-	switch s {
-	case "Horizontal (normal)":
-		return 0
-	case "Mirror vertical":
-		return 1
-	case "Mirror horizontal":
-		return 2
-	case "Rotate 180":
-		return 3
-	case "Mirror horizontal and rotate 270 CW":
-		return 4
-	case "Rotate 90 CW":
-		return 5
-	case "Rotate 270 CW":
-		return 6
-	case "Mirror horizontal and rotate 90 CW":
-		return 7
-	}
-	return OrientationInvalid
-}
-
 /* internal helpers, lazy loaders, etc */
 
 // run callback if property exists, and successfully converts
@@ -558,8 +577,7 @@ func (p *Photo) loadXMPFromDB() (XMP, error) {
 func (p Photo) ThumbSizes() map[Size]Resource {
 	sizes := []Size{SizeXS, SizeSmall, SizeMedium, SizeLarge, SizeXL, SizeFull}
 	host := p.ctx.Value("host").(string)
-	relpath := p.Relpath()
-	jpg := strings.TrimSuffix(relpath, filepath.Ext(relpath)) + ".jpg"
+	jpg := formats.ThumbName(p.Relpath())
 	w, h := p.Size()
 	thumbs := make(map[Size]Resource, len(sizes))
 	for _, s := range sizes {
@@ -600,6 +618,8 @@ func (p Photo) MarshalJSON() ([]byte, error) {
 		Meta        map[string]interface{} `json:"meta"` // xmp/exif merge
 		Thumbs      map[Size]Resource      `json:"thumbs"`
 		Original    Resource               `json:"original"`
+		Stack       *StackInfo             `json:"stack,omitempty"`
+		Sources     []string               `json:"sources,omitempty"` // with siblings, every source file
 	}
 
 	fs, err := p.FileSize()
@@ -642,6 +662,8 @@ func (p Photo) MarshalJSON() ([]byte, error) {
 			Height: h,
 			URL:    "http://" + host + "/api/v1/photos/" + relpath,
 		},
+		Stack:   p.Stack(),
+		Sources: p.Sources(),
 	}
 
 	data, err := json.Marshal(j)
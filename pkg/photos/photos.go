@@ -2,8 +2,16 @@ package photos
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/pzl/phumpkin/pkg/geo"
+	"github.com/pzl/phumpkin/pkg/ignore"
+	"github.com/pzl/phumpkin/pkg/watch"
 	"github.com/sirupsen/logrus"
 )
 
@@ -11,22 +19,110 @@ type Mgr struct {
 	indexer Indexer
 }
 
-func New() *Mgr {
-	return &Mgr{}
+type Opt func(m *Mgr)
+
+// longest time between shots of a stack. 0 disables stacking
+func StackGap(d time.Duration) Opt { return func(m *Mgr) { m.indexer.stackGap = d } }
+
+// which of RAW+JPEG siblings stands for the photo, PreferRaw or PreferJPEG
+func PreferSource(s string) Opt { return func(m *Mgr) { m.indexer.prefer = s } }
+
+// how to watch the library for changes: watch.Auto, watch.Notify or watch.Poll
+func WatchMode(mode string) Opt { return func(m *Mgr) { m.indexer.watchMode = mode } }
+
+// time between scans when polling
+func PollInterval(d time.Duration) Opt { return func(m *Mgr) { m.indexer.pollInterval = d } }
+
+func New(opts ...Opt) *Mgr {
+	m := &Mgr{}
+	m.indexer.stackGap = DefaultStackGap
+	m.indexer.prefer = PreferRaw
+	m.indexer.watchMode = watch.Auto
+	m.indexer.pollInterval = watch.DefaultInterval
+	for _, o := range opts {
+		if o != nil {
+			o(m)
+		}
+	}
+	return m
 }
 
-func (m *Mgr) Start(ctx context.Context) error {
-	photoDir := ctx.Value("photoDir").(string)
-	m.indexer.photoDir = photoDir
+// prepare for use without watching or indexing the library,
+// migrating the database if needed. Start does this for you
+func (m *Mgr) Open(ctx context.Context) error {
+	m.indexer.ctx = ctx
+	m.indexer.photoDir = ctx.Value("photoDir").(string)
+	if t, ok := ctx.Value("thumbDir").(string); ok {
+		m.indexer.thumbDir = t
+	}
+	if d, ok := ctx.Value("dataDir").(string); ok {
+		m.indexer.dataDir = d
+	}
 	m.indexer.log = ctx.Value("log").(logrus.FieldLogger)
+	m.indexer.rules = ignore.New(m.indexer.photoDir)
 
 	m.indexer.db = ctx.Value("badger").(*badger.DB)
+	m.indexer.ready = make(chan struct{})
+	m.indexer.stacks.kick = make(chan struct{}, 1)
+	if g, ok := ctx.Value("geocoder").(*geo.Geocoder); ok {
+		m.indexer.geocoder = g
+	}
+
+	if reindex, err := migrate(m.indexer.db, m.indexer.photoDir, m.indexer.log); err != nil {
+		return err
+	} else if reindex {
+		m.indexer.log.Info("index dropped, all photos will be re-read")
+	}
+	return nil
+}
+
+func (m *Mgr) Start(ctx context.Context) error {
+	photoDir := ctx.Value("photoDir").(string)
+	if err := m.Open(ctx); err != nil {
+		return err
+	}
 	if err := m.indexer.StartWatcher(ctx); err != nil {
 		return err
 	}
 	if err := m.indexer.Watch(photoDir); err != nil {
 		return err
 	}
-	go m.indexer.Index("", true) // recursively index the photoDir
+	go m.indexer.stackLoop(ctx)
+	// drop what went away while stopped, and index the rest. Until then
+	// the index can't be trusted for listings
+	go m.indexer.startupReconcile(ctx)
+	return nil
+}
+
+// whether a photoDir-relative path is left out of the library, for not
+// being a photo or for .phumpkinignore rules
+func (m *Mgr) Skips(file string, dir bool) bool { return m.indexer.skips(file, dir) }
+
+// hold off index writes until resume is called, for work that needs the
+// database left alone
+func (m *Mgr) Pause() (resume func()) {
+	m.indexer.pause.Lock()
+	return m.indexer.pause.Unlock
+}
+
+// progress of indexing since startup
+func (m *Mgr) Status() IndexStatus { return m.indexer.status.get() }
+
+// receive indexing status as it changes. Only the latest is kept for slow
+// readers. Unsubscribe when done
+func (m *Mgr) Subscribe() chan IndexStatus    { return m.indexer.status.subscribe() }
+func (m *Mgr) Unsubscribe(c chan IndexStatus) { m.indexer.status.unsubscribe(c) }
+
+// index a photoDir-relative file or directory tree in the background.
+// Forcing re-reads files that are already up to date
+func (m *Mgr) Reindex(path string, force bool) error {
+	if m.indexer.db == nil {
+		return errors.New("indexer not started")
+	}
+	path = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	if _, err := os.Stat(filepath.Join(m.indexer.photoDir, path)); err != nil {
+		return err
+	}
+	go m.indexer.index(path, true, force)
 	return nil
 }
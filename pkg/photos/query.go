@@ -1,13 +1,14 @@
 package photos
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"path/filepath"
 	"sort"
 
 	"github.com/dgraph-io/badger"
 	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/geo"
 	"github.com/sahilm/fuzzy"
 )
 
@@ -15,24 +16,10 @@ func GetFields(ctx context.Context, source byte, partial string) ([]string, erro
 	db := ctx.Value("badger").(*badger.DB)
 
 	keymap := make(map[string]struct{})
-	pfx := append([]byte{indexRecord, source}, []byte(partial)...)
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
-			spl := bytes.IndexByte(k, 0)
-			if spl == -1 {
-				continue
-			}
-
-			keymap[string(k[2:spl])] = struct{}{}
-		}
-
+		scanIdx(tx, idxFieldPrefix(source, partial), func(e idxEntry) {
+			keymap[e.Field] = struct{}{}
+		})
 		return nil
 	})
 	if err != nil {
@@ -52,31 +39,10 @@ func GetValues(ctx context.Context, source byte, field string, partial string) (
 	db := ctx.Value("badger").(*badger.DB)
 
 	vmap := make(map[string]struct{})
-	pfx := append([]byte{indexRecord, source}, []byte(field)...)
-	pfx = append(pfx, 0)
-	pfx = append(pfx, []byte(partial)...)
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
-			start := bytes.IndexByte(k, 0)
-			if start == -1 {
-				continue
-			}
-			start++ // skip null byte itself
-			end := bytes.IndexByte(k[start:], 0)
-			if end == -1 {
-				continue
-			}
-
-			vmap[string(k[start:start+end])] = struct{}{}
-		}
-
+		scanIdx(tx, idxValuePrefix(source, field, partial), func(e idxEntry) {
+			vmap[e.Value] = struct{}{}
+		})
 		return nil
 	})
 	if err != nil {
@@ -156,31 +122,62 @@ func GetNames(ctx context.Context, partial string) (SearchResults, error) {
 	return results, nil
 }
 
+// all photos with a location
 func WithLocation(ctx context.Context) ([]Photo, error) {
+	return located(ctx, []string{""}, nil)
+}
+
+// photos located inside the box
+func InBBox(ctx context.Context, b geo.BBox) ([]Photo, error) {
+	return located(ctx, geo.Cover(b, maxGeoCells), b.Contains)
+}
+
+// photos located within radius (meters) of a point
+func Near(ctx context.Context, lat float64, lon float64, radius float64) ([]Photo, error) {
+	return located(ctx, geo.Cover(geo.Around(lat, lon, radius), maxGeoCells), func(la, lo float64) bool {
+		return geo.Distance(lat, lon, la, lo) <= radius
+	})
+}
+
+// number of geohash prefixes to scan for an area query. More cells is
+// a tighter fit around the area, but more seeks.
+const maxGeoCells = 32
+
+// scans the geohash index under the given prefixes. keep (if not nil)
+// filters on the decoded position
+func located(ctx context.Context, cells []string, keep func(lat, lon float64) bool) ([]Photo, error) {
 	log := logger.LogFromCtx(ctx)
 	db := ctx.Value("badger").(*badger.DB)
 	photoDir := ctx.Value("photoDir").(string)
 
+	scan := func(tx *badger.Txn, source byte, found func(string)) {
+		for _, c := range cells {
+			scanIdx(tx, idxValuePrefix(source, "loc.geohash", c), func(e idxEntry) {
+				if keep == nil || keep(geo.Decode(e.Value)) {
+					found(e.File)
+				}
+			})
+		}
+	}
+
 	pmap := make(map[string]struct{})
-	pfx := []byte{indexRecord, SourceEXIF, 'G', 'P', 'S', 'L', 'a', 't'}
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
+		scan(tx, SourceXMP, func(f string) { pmap[f] = struct{}{} })
 
-			spl := bytes.LastIndexByte(k, 0)
-			if spl == -1 {
-				continue
+		// a sidecar location overrides the camera's, so only take
+		// EXIF positions from files where XMP doesn't have one
+		scan(tx, SourceEXIF, func(f string) {
+			if _, ok := pmap[f]; ok {
+				return
 			}
-
-			fname := string(k[spl+1:])
-			pmap[fname] = struct{}{}
-		}
+			var x XMP
+			if data, err := getValue(tx, DataKey(f, SourceXMP)); err == nil {
+				if err := json.Unmarshal(data, &x); err == nil && x.Location != nil && x.Location.HasCoords() {
+					return
+				}
+			}
+			pmap[f] = struct{}{}
+		})
 		return nil
 	})
 	if err != nil {
@@ -211,32 +208,11 @@ func ColorLabels(ctx context.Context, labels []string) ([]Photo, error) {
 	}
 
 	pmap := make(map[string]struct{})
-	pfx := []byte{indexRecord, SourceXMP, 'c', 'o', 'l', 'o', 'r', '_', 'l', 'a', 'b', 'e', 'l', 's', 0}
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
-
-			vstart := bytes.IndexByte(k, 0)
-			if vstart == -1 {
-				continue
-			}
-
-			vend := bytes.LastIndexByte(k, 0)
-			if vend == -1 {
-				continue
-			}
-
-			v := string(k[vstart+1 : vend])
-			if _, ok := lmap[v]; ok {
-				fname := string(k[vend+1:])
-				pmap[fname] = struct{}{}
-			}
+		for l := range lmap {
+			scanIdx(tx, idxExactPrefix(SourceXMP, "color_labels", l), func(e idxEntry) {
+				pmap[e.File] = struct{}{}
+			})
 		}
 		return nil
 	})
@@ -262,35 +238,13 @@ func ByTags(ctx context.Context, tags []string) ([]Photo, error) {
 	db := ctx.Value("badger").(*badger.DB)
 	photoDir := ctx.Value("photoDir").(string)
 
-	tb := make([][]byte, len(tags))
-	for i := range tags {
-		tb[i] = []byte(tags[i])
-	}
-
 	pmap := make(map[string]struct{})
-	pfx := []byte{indexRecord, SourceXMP, 't', 'a', 'g', 's', 0}
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-	keyLoop:
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
-
-			for _, t := range tb {
-				pfxVal := append(pfx, t...)
-				if bytes.HasPrefix(k, pfxVal) {
-					vend := bytes.LastIndexByte(k, 0)
-					if vend == -1 {
-						continue keyLoop
-					}
-					pmap[string(k[vend+1:])] = struct{}{}
-					continue keyLoop
-				}
-			}
+		// tags are hierarchical, a tag matches itself and everything below it
+		for _, t := range tags {
+			scanIdx(tx, idxValuePrefix(SourceXMP, "tags", t), func(e idxEntry) {
+				pmap[e.File] = struct{}{}
+			})
 		}
 		return nil
 	})
@@ -317,27 +271,12 @@ func HasFace(ctx context.Context) ([]Photo, error) {
 	photoDir := ctx.Value("photoDir").(string)
 
 	pmap := make(map[string]struct{})
-	pfx := []byte{indexRecord, SourceEXIF, 'F', 'a', 'c', 'e', 's', 'D', 'e', 't', 'e', 'c', 't', 'e', 'd', 0}
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
-
-			if k[len(pfx)] != '0' {
-				spl := bytes.LastIndexByte(k, 0)
-				if spl == -1 {
-					continue
-				}
-
-				fname := string(k[spl+1:])
-				pmap[fname] = struct{}{}
+		scanIdx(tx, idxValuePrefix(SourceEXIF, "FacesDetected", ""), func(e idxEntry) {
+			if e.Value != "0" {
+				pmap[e.File] = struct{}{}
 			}
-		}
+		})
 		return nil
 	})
 	if err != nil {
@@ -368,32 +307,11 @@ func ByRating(ctx context.Context, ratings []string) ([]Photo, error) {
 	}
 
 	pmap := make(map[string]struct{})
-	pfx := []byte{indexRecord, SourceXMP, 'r', 'a', 't', 'i', 'n', 'g', 0} // @ todo: this is not checking EXIF
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.Prefix = pfx
 	err := db.View(func(tx *badger.Txn) error {
-		it := tx.NewIterator(opts)
-		defer it.Close()
-		it.Rewind()
-		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
-			k := it.Item().Key()
-
-			vstart := bytes.IndexByte(k, 0)
-			if vstart == -1 {
-				continue
-			}
-
-			vend := bytes.LastIndexByte(k, 0)
-			if vend == -1 {
-				continue
-			}
-
-			v := string(k[vstart+1 : vend])
-			if _, ok := rmap[v]; ok {
-				fname := string(k[vend+1:])
-				pmap[fname] = struct{}{}
-			}
+		for r := range rmap {
+			scanIdx(tx, idxExactPrefix(SourceXMP, "rating", r), func(e idxEntry) { // @ todo: this is not checking EXIF
+				pmap[e.File] = struct{}{}
+			})
 		}
 		return nil
 	})
@@ -413,6 +331,23 @@ func ByRating(ctx context.Context, ratings []string) ([]Photo, error) {
 
 	return ps, nil
 }
+
+// call f for every index entry under a key prefix
+func scanIdx(tx *badger.Txn, pfx []byte, f func(idxEntry)) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = pfx
+	it := tx.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+		e, err := parseIdxKey(it.Item().Key())
+		if err != nil {
+			continue
+		}
+		f(e)
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -28,6 +28,7 @@ type DTXMP struct {
 		DTColorLabels        []string `xml:"colorlabels>Seq>li"`
 		Creator              []string `xml:"creator>Seq>li"`
 		Title                []string `xml:"title>Alt>li,omitempty"`
+		Description          []string `xml:"description>Alt>li,omitempty"`
 		Altitude             string   `xml:"GPSAltitude,attr"`
 		AltitudeRef          string   `xml:"GPSAltitudeRef,attr"`
 		Latitude             string   `xml:"GPSLatitude,attr"`
@@ -71,13 +72,21 @@ func ReadXMPFile(file string) (XMP, error) {
 		return XMP{}, err
 	}
 
-	rating, err := strconv.Atoi(d.Description.Rating)
-	if err != nil {
-		return XMP{}, err
+	if d.Description == nil {
+		return XMP{}, errors.New("no rdf:Description in XMP file")
 	}
-	xmpV, err := strconv.Atoi(d.Description.DTXMPVersion)
-	if err != nil {
-		return XMP{}, err
+
+	// sidecars not (yet) written by darktable may be missing these
+	var rating, xmpV int
+	if d.Description.Rating != "" {
+		if rating, err = strconv.Atoi(d.Description.Rating); err != nil {
+			return XMP{}, err
+		}
+	}
+	if d.Description.DTXMPVersion != "" {
+		if xmpV, err = strconv.Atoi(d.Description.DTXMPVersion); err != nil {
+			return XMP{}, err
+		}
 	}
 
 	ops := make([]darktable.Op, len(d.Description.DTHistory))
@@ -96,11 +105,8 @@ func ReadXMPFile(file string) (XMP, error) {
 
 	var l *Location
 	if d.Description.Latitude != "" && d.Description.Longitude != "" {
-		l = &Location{
-			Lat:      d.Description.Latitude,
-			Lon:      d.Description.Longitude,
-			Altitude: d.Description.Altitude,
-		}
+		loc := NewLocation(d.Description.Latitude, d.Description.Longitude, d.Description.Altitude, d.Description.AltitudeRef)
+		l = &loc
 	}
 
 	return XMP{
@@ -114,6 +120,7 @@ func ReadXMPFile(file string) (XMP, error) {
 		History:         ops,
 		Location:        l,
 		Title:           strings.Join(d.Description.Title, ", "),
+		Description:     strings.Join(d.Description.Description, ", "),
 		Tags:            d.Description.DTTags,
 	}, nil
 }
@@ -0,0 +1,290 @@
+package photos
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/saracen/walker"
+)
+
+// what a reconcile pass changed. Paths are photoDir-relative
+type Reconciled struct {
+	Removed  []string `json:"removed"`  // source file gone, all records dropped
+	Moved    []string `json:"moved"`    // source file found under a new path, records moved there
+	Dirs     []string `json:"dirs"`     // directories gone
+	Sidecars []string `json:"sidecars"` // XMP sidecar gone, XMP records dropped
+	Added    []string `json:"added"`    // never indexed before
+	Updated  []string `json:"updated"`  // indexed, but out of date
+	Failed   []string `json:"failed"`   // could not be fixed, see logs
+}
+
+const (
+	reconcileBatch    = 64 // files fixed per transaction, or indexed at once
+	reconcileRetry    = 5 * time.Second
+	reconcileRetryMax = 5 * time.Minute
+)
+
+// bring the index in line with the photo directory: drop records for files
+// that went away while nobody was watching, and index anything new or changed
+func (m *Mgr) Reconcile(ctx context.Context) (Reconciled, error) {
+	return m.indexer.reconcile(ctx)
+}
+
+func (idx *Indexer) reconcile(ctx context.Context) (Reconciled, error) {
+	idx.reconciling.Lock()
+	defer idx.reconciling.Unlock()
+
+	var r Reconciled
+	l := idx.log.WithField("pass", "reconcile")
+	l.Debug("reconciling index with photo directory")
+
+	indexed, err := idx.indexedFiles()
+	if err != nil {
+		return r, err
+	}
+	files, libDirs, err := idx.libraryFiles(ctx)
+	if err != nil {
+		return r, err
+	}
+
+	// records whose files are gone, or ignored now
+	drops := make(map[string][]byte)
+	var gone []string
+	for file, srcs := range indexed {
+		fullpath := filepath.Join(idx.photoDir, file)
+		if idx.skips(file, false) {
+			drops[file] = []byte{SourceEXIF, SourceXMP}
+			r.Removed = append(r.Removed, file)
+			continue
+		}
+		if _, err := os.Stat(fullpath); os.IsNotExist(err) {
+			drops[file] = []byte{SourceEXIF, SourceXMP}
+			gone = append(gone, file)
+			continue
+		}
+		if srcs[SourceXMP] {
+			if _, err := os.Stat(fullpath + ".xmp"); os.IsNotExist(err) {
+				drops[file] = []byte{SourceXMP}
+				r.Sidecars = append(r.Sidecars, file)
+			}
+		}
+	}
+	// unless they moved
+	moved := idx.reconcileMoves(gone, files, indexed)
+	for _, file := range gone {
+		if to, ok := moved[file]; ok {
+			delete(drops, file)
+			indexed[to] = indexed[file]
+			r.Moved = append(r.Moved, to)
+			if indexed[to][SourceXMP] {
+				if _, err := os.Stat(filepath.Join(idx.photoDir, to) + ".xmp"); os.IsNotExist(err) {
+					drops[to] = []byte{SourceXMP}
+					r.Sidecars = append(r.Sidecars, to)
+				}
+			}
+		} else {
+			r.Removed = append(r.Removed, file)
+		}
+	}
+	r.Failed = append(r.Failed, idx.dropBatched(drops)...)
+
+	// directory listings
+	var dirs []string
+	err = idx.db.View(func(tx *badger.Txn) error {
+		_, dirs = dirTree(tx, "")
+		return nil
+	})
+	if err != nil {
+		return r, err
+	}
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(idx.photoDir, d)); os.IsNotExist(err) || idx.skips(d, true) {
+			if err := idx.dropIndex(d); err != nil {
+				l.WithError(err).WithField("dir", d).Error("unable to drop directory")
+				r.Failed = append(r.Failed, d)
+				continue
+			}
+			r.Dirs = append(r.Dirs, d)
+		}
+	}
+
+	// files never indexed, or changed since
+	for i := 0; i < len(libDirs); i += reconcileBatch {
+		batch := libDirs[i:min(i+reconcileBatch, len(libDirs))]
+		err := idx.update(func(tx *badger.Txn) error {
+			for _, d := range batch {
+				if err := ensureDirs(tx, d); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return r, err
+		}
+	}
+	for i := 0; i < len(files); i += reconcileBatch {
+		end := i + reconcileBatch
+		if end > len(files) {
+			end = len(files)
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		idx.status.queue(end - i)
+		for _, file := range files[i:end] {
+			_, known := indexed[file]
+			wg.Add(1)
+			go func(file string) {
+				defer wg.Done()
+				read, err := idx.indexFileIfNeeded(file, false)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err != nil:
+					r.Failed = append(r.Failed, file)
+				case !read:
+				case known:
+					r.Updated = append(r.Updated, file)
+				default:
+					r.Added = append(r.Added, file)
+				}
+			}(file)
+		}
+		wg.Wait()
+
+		if err := ctx.Err(); err != nil {
+			return r, err
+		}
+	}
+
+	for _, s := range [][]string{r.Removed, r.Moved, r.Dirs, r.Sidecars, r.Added, r.Updated, r.Failed} {
+		sort.Strings(s)
+	}
+	l.WithField("removed", len(r.Removed)).
+		WithField("moved", len(r.Moved)).
+		WithField("dirs", len(r.Dirs)).
+		WithField("sidecars", len(r.Sidecars)).
+		WithField("added", len(r.Added)).
+		WithField("updated", len(r.Updated)).
+		WithField("failed", len(r.Failed)).
+		Info("index reconciled")
+	return r, nil
+}
+
+// every file with a primary record, and which sources it has
+func (idx *Indexer) indexedFiles() (map[string]map[byte]bool, error) {
+	files := make(map[string]map[byte]bool)
+	pfx := []byte{primaryRecord}
+	err := idx.db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			k := it.Item().Key()
+			if len(k) < 4 {
+				continue
+			}
+			file := string(k[3:])
+			if files[file] == nil {
+				files[file] = make(map[byte]bool, 2)
+			}
+			files[file][k[1]] = true
+		}
+		return nil
+	})
+	return files, err
+}
+
+// reconcile at startup, retrying with backoff until it works or ctx is
+// done. Listings come from the disk until then
+func (idx *Indexer) startupReconcile(ctx context.Context) {
+	wait := reconcileRetry
+	for {
+		_, err := idx.reconcile(ctx)
+		idx.status.reconciled(err)
+		if err == nil {
+			close(idx.ready)
+			return
+		}
+		idx.log.WithError(err).WithField("retry", wait).Error("unable to reconcile index")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > reconcileRetryMax {
+			wait = reconcileRetryMax
+		}
+	}
+}
+
+// every photo and directory in the library, photoDir-relative
+func (idx *Indexer) libraryFiles(ctx context.Context) ([]string, []string, error) {
+	var mu sync.Mutex
+	files := make([]string, 0, 1000)
+	dirs := make([]string, 0, 100)
+	err := walker.WalkWithContext(ctx, idx.photoDir, func(name string, fi os.FileInfo) error {
+		if name == idx.photoDir || idx.skips(idx.relpath(name), fi.IsDir()) {
+			if fi.IsDir() && name != idx.photoDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mu.Lock()
+		if fi.IsDir() {
+			dirs = append(dirs, idx.relpath(name))
+		} else {
+			files = append(files, idx.relpath(name))
+		}
+		mu.Unlock()
+		return nil
+	})
+	sort.Strings(files)
+	sort.Strings(dirs)
+	return files, dirs, err
+}
+
+// drops records for files, several to a transaction. Returns the files that failed
+func (idx *Indexer) dropBatched(drops map[string][]byte) []string {
+	var failed []string
+	batch := make([]string, 0, reconcileBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := idx.update(func(tx *badger.Txn) error {
+			for _, file := range batch {
+				if err := dropRecords(tx, file, drops[file]...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			idx.log.WithError(err).WithField("files", len(batch)).Error("unable to drop stale records")
+			failed = append(failed, batch...)
+		} else {
+			for _, file := range batch {
+				idx.stacks.mark(path.Dir(file))
+			}
+		}
+		batch = batch[:0]
+	}
+	for file := range drops {
+		batch = append(batch, file)
+		if len(batch) == reconcileBatch {
+			flush()
+		}
+	}
+	flush()
+	return failed
+}
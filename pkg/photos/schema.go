@@ -0,0 +1,431 @@
+package photos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	Schema versioning.
+
+	key: metaRecord + "schema"
+	value: uint32, BigEndian
+
+	Bump schemaVersion whenever the records the indexer writes change
+	shape, and add a migration from the previous version if the old
+	records can be converted. Migrations only run when every step up to
+	the current version has one. Otherwise everything derived from the
+	library is dropped and re-read from the files, without spending time
+	on steps that would be dropped anyway.
+
+	history:
+		0: unversioned
+		1: decimal GPS, geohash and place name index fields
+		2: escaped index key parts (keys.go)
+		3: per-file index list records
+		4: text index, XMP descriptions
+		5: directory entries
+		6: sort indexes, file modification times
+		7: content hashes
+		8: perceptual hashes
+		9: capture details for stacking, stacks
+*/
+
+const schemaVersion = 9
+
+var schemaKey = []byte{metaRecord, 's', 'c', 'h', 'e', 'm', 'a'}
+
+// migrations[n] upgrades a database from version n to n+1
+var migrations = map[int]func(db *badger.DB, photoDir string) error{
+	1: migrateIdxEscaping,
+	2: migrateIdxLists,
+	3: rereadSources(SourceEXIF, SourceXMP), // text needs the full metadata, descriptions the sidecars
+	4: migrateDirEntries,
+	5: migrateSortKeys,
+	6: rereadSources(SourceEXIF), // hashing reads every file anyway
+	7: rereadSources(SourceEXIF), // perceptual hashes need the previews
+	8: migrateCaptureDetails,
+}
+
+// bring the database up to the current schema. Returns true if records
+// had to be dropped, and a full reindex is needed
+func migrate(db *badger.DB, photoDir string, log logrus.FieldLogger) (bool, error) {
+	v, err := readSchemaVersion(db)
+	if err != nil {
+		return false, err
+	}
+	l := log.WithField("from", v).WithField("to", schemaVersion)
+	if v == schemaVersion {
+		l.Trace("database schema up to date")
+		return false, nil
+	}
+
+	for v < schemaVersion && migratable(v) {
+		m := migrations[v]
+		l.WithField("step", v).Info("migrating database schema")
+		if err := m(db, photoDir); err != nil {
+			return false, fmt.Errorf("migrating database from version %d: %w", v, err)
+		}
+		v++
+		if err := writeSchemaVersion(db, v); err != nil {
+			return false, err
+		}
+	}
+	if v == schemaVersion {
+		return false, nil
+	}
+
+	// either no path forward, or a newer version wrote this database
+	l.Warn("unable to migrate database schema. Dropping index for a full reindex")
+	if err := dropDerived(db); err != nil {
+		return true, err
+	}
+	return true, writeSchemaVersion(db, schemaVersion)
+}
+
+// whether there's a migration for every step from version v to the current one
+func migratable(v int) bool {
+	for ; v < schemaVersion; v++ {
+		if _, ok := migrations[v]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// version of the stored data. A database without a version is either brand
+// new (current version), or from before versioning (0)
+func readSchemaVersion(db *badger.DB) (int, error) {
+	v := -1
+	err := db.View(func(tx *badger.Txn) error {
+		b, err := getValue(tx, schemaKey)
+		if err == nil {
+			if len(b) != 4 {
+				return fmt.Errorf("invalid schema version record")
+			}
+			v = int(binary.BigEndian.Uint32(b))
+			return nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		it.Seek([]byte{primaryRecord})
+		if it.Valid() {
+			v = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if v == -1 {
+		// empty database, nothing to migrate
+		return schemaVersion, writeSchemaVersion(db, schemaVersion)
+	}
+	return v, nil
+}
+
+func writeSchemaVersion(db *badger.DB, v int) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return db.Update(func(tx *badger.Txn) error {
+		return tx.Set(schemaKey, b)
+	})
+}
+
+// remove everything the indexer derives from the library
+func dropDerived(db *badger.DB) error {
+	for _, pfx := range [][]byte{{primaryRecord}, {indexRecord}, {textRecord}, {dirRecord}, {sortRecord}, {phashRecord}} {
+		if err := db.DropPrefix(pfx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// records that can only come from the files are read again by the startup
+// reconcile. Forgetting when a source was read makes it stale, and what's
+// stored stays in place until then
+func rereadSources(sources ...byte) func(db *badger.DB, photoDir string) error {
+	return func(db *badger.DB, photoDir string) error {
+		for _, s := range sources {
+			if err := db.DropPrefix([]byte{primaryRecord, s, TimestampRecord}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// 1 -> 2: index keys were field 0 value 0 file. Re-encode them with the
+// key codec, splitting on the first and last null like the old readers did
+func migrateIdxEscaping(db *badger.DB, photoDir string) error {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	pfx := []byte{indexRecord}
+	err := db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			k := it.Item().KeyCopy(nil)
+			if err := wb.Delete(k); err != nil {
+				return err
+			}
+			fend := bytes.IndexByte(k[2:], 0)
+			vend := bytes.LastIndexByte(k, 0)
+			if fend == -1 || vend <= fend+2 {
+				continue // unreadable, drop it
+			}
+			e := idxEntry{
+				Source: k[1],
+				Field:  string(k[2 : fend+2]),
+				Value:  string(k[fend+3 : vend]),
+				File:   string(k[vend+1:]),
+			}
+			if err := wb.SetEntry(badger.NewEntry(e.key(), nil).WithDiscard()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// 2 -> 3: write the list of index keys for every file and source. Index keys
+// are ordered by field, so the lists are gathered up in full before writing
+func migrateIdxLists(db *badger.DB, photoDir string) error {
+	lists := make(map[string][][]byte)
+
+	pfx := []byte{indexRecord}
+	err := db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			k := it.Item().KeyCopy(nil)
+			e, err := parseIdxKey(k)
+			if err != nil {
+				continue
+			}
+			lk := string(IdxListKey(e.File, e.Source))
+			lists[lk] = append(lists[lk], k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for lk, keys := range lists {
+		if err := wb.SetEntry(badger.NewEntry([]byte(lk), encodeKeyList(keys)).WithDiscard()); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// 4 -> 5: list every indexed file in its directory, with sort keys
+// from the index fields already stored for it
+func migrateDirEntries(db *badger.DB, photoDir string) error {
+	fields := make(map[string]map[byte][][2]string)
+
+	pfx := []byte{indexRecord}
+	err := db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			e, err := parseIdxKey(it.Item().Key())
+			if err != nil {
+				continue
+			}
+			switch e.Field {
+			case "DateTimeOriginal", "Rating", "rating", "derived_from":
+			default:
+				continue
+			}
+			if fields[e.File] == nil {
+				fields[e.File] = make(map[byte][][2]string, 2)
+			}
+			fields[e.File][e.Source] = append(fields[e.File][e.Source], [2]string{e.Field, e.Value})
+		}
+
+		// files without any of those fields still need listing
+		dpfx := []byte{primaryRecord, SourceEXIF, DataRecord}
+		opts.Prefix = dpfx
+		dit := tx.NewIterator(opts)
+		defer dit.Close()
+		for dit.Seek(dpfx); dit.ValidForPrefix(dpfx); dit.Next() {
+			f := string(dit.Item().Key()[3:])
+			if fields[f] == nil {
+				fields[f] = make(map[byte][][2]string, 2)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(fields))
+	for f := range fields {
+		files = append(files, f)
+	}
+	for i := 0; i < len(files); i += reconcileBatch {
+		batch := files[i:min(i+reconcileBatch, len(files))]
+		err := update(db, func(tx *badger.Txn) error {
+			for _, f := range batch {
+				err := updateDirEntry(tx, f, func(e *dirEntry) {
+					e.set(SourceEXIF, fields[f][SourceEXIF])
+					e.set(SourceXMP, fields[f][SourceXMP])
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 5 -> 6: sorted indexes for every directory entry, now that they carry
+// the file's modification time
+func migrateSortKeys(db *badger.DB, photoDir string) error {
+	entries := make(map[string]dirEntry)
+
+	pfx := []byte{dirRecord}
+	err := db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			f, kind, err := parseDirKey(it.Item().Key())
+			if err != nil || kind != dirFile {
+				continue
+			}
+			var e dirEntry
+			if err := it.Item().Value(func(v []byte) error { return json.Unmarshal(v, &e) }); err != nil {
+				return err
+			}
+			entries[f] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// anything written before this version has no business in the sort indexes
+	if err := db.DropPrefix([]byte{sortRecord}); err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for f, e := range entries {
+		if fi, err := os.Stat(filepath.Join(photoDir, f)); err == nil {
+			e.ModTime = fi.ModTime().UnixNano()
+		}
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set(dirKey(f, dirFile), v); err != nil {
+			return err
+		}
+		for _, kind := range sortKinds {
+			if err := wb.Set(sortKey(kind, f, e.sortValue(kind)), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return wb.Flush()
+}
+
+// 8 -> 9: capture details in directory entries, from the EXIF fields
+// already indexed for each file. Stacks follow, since nothing was
+// grouped before
+func migrateCaptureDetails(db *badger.DB, photoDir string) error {
+	fields := make(map[string][][2]string)
+
+	pfx := []byte{primaryRecord, SourceEXIF, IdxListRecord}
+	err := db.View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			f := string(it.Item().Key()[3:])
+			var keys [][]byte
+			err := it.Item().Value(func(v []byte) error {
+				var err error
+				keys, err = decodeKeyList(v)
+				return err
+			})
+			if err != nil {
+				continue
+			}
+			for _, k := range keys {
+				if e, err := parseIdxKey(k); err == nil {
+					fields[f] = append(fields[f], [2]string{e.Field, e.Value})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(fields))
+	for f := range fields {
+		files = append(files, f)
+	}
+	for i := 0; i < len(files); i += reconcileBatch {
+		batch := files[i:min(i+reconcileBatch, len(files))]
+		err := update(db, func(tx *badger.Txn) error {
+			for _, f := range batch {
+				if _, err := tx.Get(dirKey(f, dirFile)); err != nil {
+					continue // not listed, the reconcile will
+				}
+				if err := updateDirEntry(tx, f, func(e *dirEntry) { e.set(SourceEXIF, fields[f]) }); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
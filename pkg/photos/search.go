@@ -0,0 +1,270 @@
+package photos
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/query"
+)
+
+/*
+	Runs a query (see pkg/query) against the index.
+
+	Fields are index field names. Prefix with exif. or xmp. to pick
+	a source, otherwise both are searched. Some shorthands:
+
+		label:red     darktable color labels, by name or number
+		tags:Places   a tag, and every tag below it in the hierarchy
+		rating>=3     from the sidecar
+
+	Each term is one or more prefix scans, giving a set of files.
+	AND intersects, OR unions, and NOT subtracts from whatever it is
+	ANDed with, or from every indexed file when alone.
+*/
+
+// darktable's color label numbering
+var labelNames = map[string]string{
+	"red":    "0",
+	"yellow": "1",
+	"green":  "2",
+	"blue":   "3",
+	"purple": "4",
+}
+
+type fileSet map[string]struct{}
+
+// photos matching a query. They aren't looked at on disk, so a page of them
+// can be taken (see Page) before reading anything of the rest
+func Search(ctx context.Context, q string) ([]Photo, error) {
+	log := logger.LogFromCtx(ctx)
+	db := ctx.Value("badger").(*badger.DB)
+	photoDir := ctx.Value("photoDir").(string)
+
+	n, err := query.Parse(q)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("query", n.String()).Debug("running search")
+
+	var files fileSet
+	err = db.View(func(tx *badger.Txn) error {
+		var err error
+		files, err = (&planner{tx: tx}).eval(n)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ps := make([]Photo, 0, len(files))
+	for k := range files {
+		ps = append(ps, Photo{Src: photoDir + "/" + k, ctx: ctx})
+	}
+	return ps, nil
+}
+
+type planner struct {
+	tx  *badger.Txn
+	all fileSet // every indexed file, loaded if needed
+}
+
+func (p *planner) eval(n query.Node) (fileSet, error) {
+	switch n := n.(type) {
+	case query.And:
+		// subtract negations rather than building their complement
+		if x, ok := n.R.(query.Not); ok {
+			return p.without(n.L, x.X)
+		}
+		if x, ok := n.L.(query.Not); ok {
+			return p.without(n.R, x.X)
+		}
+		l, err := p.eval(n.L)
+		if err != nil || len(l) == 0 {
+			return l, err
+		}
+		r, err := p.eval(n.R)
+		if err != nil {
+			return nil, err
+		}
+		return intersect(l, r), nil
+	case query.Or:
+		l, err := p.eval(n.L)
+		if err != nil {
+			return nil, err
+		}
+		r, err := p.eval(n.R)
+		if err != nil {
+			return nil, err
+		}
+		for f := range r {
+			l[f] = struct{}{}
+		}
+		return l, nil
+	case query.Not:
+		return p.without(nil, n.X)
+	case query.Term:
+		return p.term(n)
+	default:
+		return nil, fmt.Errorf("unknown query node %T", n)
+	}
+}
+
+// files in keep (or all files, if nil) not matching drop
+func (p *planner) without(keep query.Node, drop query.Node) (fileSet, error) {
+	var k fileSet
+	if keep == nil {
+		if p.all == nil {
+			p.all = p.indexed()
+		}
+		k = make(fileSet, len(p.all))
+		for f := range p.all {
+			k[f] = struct{}{}
+		}
+	} else {
+		var err error
+		if k, err = p.eval(keep); err != nil || len(k) == 0 {
+			return k, err
+		}
+	}
+	d, err := p.eval(drop)
+	if err != nil {
+		return nil, err
+	}
+	for f := range d {
+		delete(k, f)
+	}
+	return k, nil
+}
+
+func (p *planner) term(t query.Term) (fileSet, error) {
+	if t.Op == query.Ne {
+		t.Op = query.Eq
+		return p.without(nil, t)
+	}
+
+	sources, field := resolveField(t.Field)
+	value := t.Value
+	if field == "color_labels" {
+		if v, ok := labelNames[strings.ToLower(value)]; ok {
+			value = v
+		}
+	}
+
+	files := make(fileSet)
+	found := func(e idxEntry) { files[e.File] = struct{}{} }
+	for _, src := range sources {
+		switch {
+		case t.Op == query.Eq && t.Prefix:
+			scanIdx(p.tx, idxValuePrefix(src, field, value), found)
+		case t.Op == query.Eq && field == "tags":
+			scanIdx(p.tx, idxExactPrefix(src, field, value), found)
+			scanIdx(p.tx, idxValuePrefix(src, field, value+"|"), found)
+		case t.Op == query.Eq:
+			scanIdx(p.tx, idxExactPrefix(src, field, value), found)
+		default:
+			cmp, err := comparison(t.Op, value)
+			if err != nil {
+				return nil, err
+			}
+			scanIdx(p.tx, idxValuePrefix(src, field, ""), func(e idxEntry) {
+				if cmp(e.Value) {
+					found(e)
+				}
+			})
+		}
+	}
+	return files, nil
+}
+
+// which sources and index field a query field refers to
+func resolveField(f string) ([]byte, string) {
+	switch lf := strings.ToLower(f); {
+	case strings.HasPrefix(lf, "exif."):
+		return []byte{SourceEXIF}, f[len("exif."):]
+	case strings.HasPrefix(lf, "xmp."):
+		return []byte{SourceXMP}, f[len("xmp."):]
+	case lf == "label" || lf == "labels" || lf == "color" || lf == "color_labels":
+		return []byte{SourceXMP}, "color_labels"
+	case lf == "tag" || lf == "tags":
+		return []byte{SourceXMP}, "tags"
+	case lf == "rating" || lf == "title" || lf == "creator" || lf == "rights" || lf == "history":
+		return []byte{SourceXMP}, lf
+	default:
+		return []byte{SourceXMP, SourceEXIF}, f
+	}
+}
+
+// ordering test for index values against v. Numeric if both are numbers
+func comparison(op query.Op, v string) (func(string) bool, error) {
+	want := func(c int) bool {
+		switch op {
+		case query.Gt:
+			return c > 0
+		case query.Gte:
+			return c >= 0
+		case query.Lt:
+			return c < 0
+		case query.Lte:
+			return c <= 0
+		}
+		return false
+	}
+	switch op {
+	case query.Gt, query.Gte, query.Lt, query.Lte:
+	default:
+		return nil, fmt.Errorf("unsupported operator %s", op)
+	}
+
+	vf, verr := strconv.ParseFloat(v, 64)
+	return func(s string) bool {
+		if verr == nil {
+			sf, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return false
+			}
+			switch {
+			case sf < vf:
+				return want(-1)
+			case sf > vf:
+				return want(1)
+			default:
+				return want(0)
+			}
+		}
+		return want(strings.Compare(s, v))
+	}, nil
+}
+
+// every file with data from either source
+func (p *planner) indexed() fileSet {
+	files := make(fileSet)
+	for _, src := range []byte{SourceEXIF, SourceXMP} {
+		pfx := []byte{primaryRecord, src, DataRecord}
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := p.tx.NewIterator(opts)
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			files[string(it.Item().Key()[3:])] = struct{}{}
+		}
+		it.Close()
+	}
+	return files
+}
+
+func intersect(a, b fileSet) fileSet {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	out := make(fileSet, len(a))
+	for f := range a {
+		if _, ok := b[f]; ok {
+			out[f] = struct{}{}
+		}
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+package photos
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pzl/phumpkin/pkg/formats"
+)
+
+/*
+	RAW+JPEG siblings.
+
+	Cameras shooting RAW+JPEG write every frame twice, as IMG_1.ARW and
+	IMG_1.JPG. Files in one directory named the same up to their extension
+	are siblings: one photo with several source files. The preferred
+	source stands for the photo in listings, stacks and thumbnails, and
+	carries the names of the others.
+
+	Siblings are paired in the same pass as stacks, so a RAW+JPEG burst
+	stacks once.
+*/
+
+const (
+	PreferRaw  = "raw"
+	PreferJPEG = "jpeg"
+)
+
+// file name without its extension
+func siblingBase(file string) string { return strings.TrimSuffix(file, filepath.Ext(file)) }
+
+// how well a file stands for its photo, lower is better
+func sourceRank(file string, prefer string) int {
+	raw, jpeg := formats.IsRaw(file), formats.IsJPEG(file)
+	switch {
+	case prefer == PreferRaw && raw, prefer == PreferJPEG && jpeg:
+		return 0
+	case raw, jpeg:
+		return 1
+	}
+	return 2
+}
+
+// sort siblings, the preferred source first
+func sortSources(files []string, prefer string) {
+	sort.Slice(files, func(i, j int) bool {
+		ri, rj := sourceRank(files[i], prefer), sourceRank(files[j], prefer)
+		if ri != rj {
+			return ri < rj
+		}
+		return files[i] < files[j]
+	})
+}
+
+// a file's place among its siblings. The preferred source lists the
+// others, and the others name it
+type pairing struct {
+	primary  string
+	siblings []string
+}
+
+// sibling groups among the files of a directory, by file name. Files
+// without siblings are left out
+func pairSiblings(names []string, prefer string) map[string]pairing {
+	byBase := make(map[string][]string)
+	for _, n := range names {
+		b := siblingBase(n)
+		byBase[b] = append(byBase[b], n)
+	}
+	pairs := make(map[string]pairing)
+	for _, g := range byBase {
+		if len(g) < 2 {
+			continue
+		}
+		sortSources(g, prefer)
+		pairs[g[0]] = pairing{siblings: append([]string{}, g[1:]...)}
+		for _, n := range g[1:] {
+			pairs[n] = pairing{primary: g[0]}
+		}
+	}
+	return pairs
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the file that stands for a photoDir-relative file, itself unless it's
+// a sibling of the preferred source
+func (m *Mgr) Primary(file string) string {
+	if m.indexer.db == nil {
+		return file
+	}
+	var e dirEntry
+	if err := fetchJSON(m.indexer.db, dirKey(file, dirFile), &e); err != nil || e.Primary == "" {
+		return file
+	}
+	return path.Join(path.Dir(file), e.Primary)
+}
+
+// the preferred of some siblings
+func (m *Mgr) PickSource(files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	s := append([]string{}, files...)
+	sortSources(s, m.indexer.prefer)
+	return s[0]
+}
+
+// photos without the siblings of their preferred sources, for listings
+// that don't come from the index
+func (m *Mgr) DropSiblings(ps []Photo) []Photo {
+	byBase := make(map[string][]int)
+	for i, p := range ps {
+		b := siblingBase(p.Src)
+		byBase[b] = append(byBase[b], i)
+	}
+	keep := make([]Photo, 0, len(ps))
+	for _, p := range ps {
+		g := byBase[siblingBase(p.Src)]
+		if len(g) > 1 {
+			srcs := make([]string, len(g))
+			for k, j := range g {
+				srcs[k] = ps[j].Src
+			}
+			if m.PickSource(srcs) != p.Src {
+				continue
+			}
+		}
+		keep = append(keep, p)
+	}
+	return keep
+}
+
+// every source file of a photo, photoDir-relative, the preferred first
+func (p *Photo) Sources() []string {
+	e := p.dirEntry()
+	if len(e.Siblings) == 0 {
+		return nil
+	}
+	rel := p.Relpath()
+	srcs := []string{rel}
+	for _, s := range e.Siblings {
+		srcs = append(srcs, path.Join(path.Dir(rel), s))
+	}
+	return srcs
+}
+
+// the photo a query result stands for: its preferred source, if it's a
+// sibling of one
+func primaryPhoto(ctx context.Context, p Photo, e dirEntry) Photo {
+	if e.Primary == "" {
+		return p
+	}
+	return Photo{Src: filepath.Join(filepath.Dir(p.Src), e.Primary), ctx: ctx}
+}
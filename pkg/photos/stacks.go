@@ -0,0 +1,374 @@
+package photos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+	Stacks: bursts and exposure brackets.
+
+	Shots from the same body, each within the stack gap of the one
+	before it, are stacked. Where the camera numbers its continuous
+	shots (SequenceNumber), the numbers must also follow on. Shots the
+	camera says were taken one at a time only stack when their exposure
+	compensation differs, as when bracketing by hand or in single drive.
+
+	A stack is a bracket if its exposure compensation varies, a burst
+	otherwise. Its cover is the best rated photo, then for brackets the
+	one nearest 0 EV, then the earliest.
+
+	Stacks are kept in the directory entries, so listings can show only
+	covers without reading anything else. Directories are restacked in
+	the background a little after their photos are indexed or dropped,
+	pairing siblings first (see siblings.go).
+
+	key: metaRecord + "grouping"
+	value: JSON grouping, the settings stacks and siblings were made
+		with, to restack everything when they change
+*/
+
+const (
+	DefaultStackGap = time.Second
+	stackSettle     = 2 * time.Second // wait for more changes to a directory before restacking it
+
+	StackBurst   = "burst"
+	StackBracket = "bracket"
+)
+
+var groupingKey = []byte{metaRecord, 'g', 'r', 'o', 'u', 'p', 'i', 'n', 'g'}
+
+type grouping struct {
+	Gap    int64  `json:"gap"` // ms
+	Prefer string `json:"prefer"`
+}
+
+// a photo's place in a stack
+type StackInfo struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Size  int    `json:"size"`
+	Cover bool   `json:"cover"`
+}
+
+// directories waiting to be restacked
+type stacker struct {
+	mu    sync.Mutex
+	dirty map[string]struct{}
+	kick  chan struct{}
+}
+
+func (s *stacker) mark(dir string) {
+	s.mu.Lock()
+	if s.dirty == nil {
+		s.dirty = make(map[string]struct{})
+	}
+	s.dirty[dir] = struct{}{}
+	s.mu.Unlock()
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stacker) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirs := make([]string, 0, len(s.dirty))
+	for d := range s.dirty {
+		dirs = append(dirs, d)
+	}
+	s.dirty = nil
+	sort.Strings(dirs)
+	return dirs
+}
+
+// capture time in unix ms, with subseconds, from the camera's clock
+func shotTime(subsec string, dto string, ss string) int64 {
+	v := subsec
+	if v == "" {
+		v = dto
+	}
+	if len(v) < 19 {
+		return 0
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", v[:19])
+	if err != nil {
+		return 0
+	}
+	frac := ""
+	if subsec != "" && len(v) > 20 && v[19] == '.' {
+		frac = v[20:]
+		if i := strings.IndexAny(frac, "+-Z"); i >= 0 {
+			frac = frac[:i]
+		}
+	} else if subsec == "" {
+		frac = ss
+	}
+	if d, err := time.ParseDuration("0." + frac + "s"); err == nil && frac != "" {
+		t = t.Add(d)
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// exposure compensation in stops. exiftool writes fractions, like +1/3
+func parseEV(s string) float64 {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "+")
+	if i := strings.IndexByte(s, '/'); i > 0 {
+		n, nerr := strconv.ParseFloat(s[:i], 64)
+		d, derr := strconv.ParseFloat(s[i+1:], 64)
+		if nerr != nil || derr != nil || d == 0 {
+			return 0
+		}
+		return n / d
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+// whether b follows a in the same stack. a was shot first
+func stacksWith(a dirEntry, b dirEntry, gap time.Duration) bool {
+	if a.Body == "" || a.Body != b.Body || a.Shot == 0 || b.Shot == 0 {
+		return false
+	}
+	if gap <= 0 || b.Shot-a.Shot > int64(gap/time.Millisecond) {
+		return false
+	}
+	as, aerr := strconv.Atoi(a.Seq)
+	bs, berr := strconv.Atoi(b.Seq)
+	switch {
+	case aerr == nil && berr == nil:
+		return bs == as+1
+	case a.Seq != "" || b.Seq != "": // single shot drive
+		return parseEV(a.EV) != parseEV(b.EV)
+	}
+	return true // the camera doesn't say, go by time
+}
+
+func stackID(file string) string {
+	h := fnv.New64a()
+	h.Write([]byte(file)) // nolint
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+type stackShot struct {
+	file string
+	e    dirEntry
+}
+
+// assign stacks to shots, which are sorted by body and time
+func stackShots(shots []stackShot, gap time.Duration) map[string]*StackInfo {
+	stacks := make(map[string]*StackInfo, len(shots))
+	for i := 0; i < len(shots); {
+		j := i + 1
+		for j < len(shots) && stacksWith(shots[j-1].e, shots[j].e, gap) {
+			j++
+		}
+		g := shots[i:j]
+		i = j
+		if len(g) < 2 {
+			continue
+		}
+
+		kind := StackBurst
+		for _, s := range g[1:] {
+			if parseEV(s.e.EV) != parseEV(g[0].e.EV) {
+				kind = StackBracket
+				break
+			}
+		}
+		cover := 0
+		for k, s := range g {
+			c := g[cover].e
+			switch {
+			case s.e.rating() > c.rating():
+				cover = k
+			case s.e.rating() == c.rating() && kind == StackBracket &&
+				math.Abs(parseEV(s.e.EV)) < math.Abs(parseEV(c.EV)):
+				cover = k
+			}
+		}
+		id := stackID(g[0].file)
+		for k, s := range g {
+			stacks[s.file] = &StackInfo{ID: id, Kind: kind, Size: len(g), Cover: k == cover}
+		}
+	}
+	return stacks
+}
+
+// work out the siblings and stacks of a directory again, and write the
+// entries that changed
+func (idx *Indexer) restack(dir string) error {
+	current := make(map[string]dirEntry)
+	names := make([]string, 0, 100)
+	err := idx.db.View(func(tx *badger.Txn) error {
+		pfx := dirPrefix(dir, dirFile)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			f, _, err := parseDirKey(it.Item().Key())
+			if err != nil {
+				continue
+			}
+			e, err := getDirEntry(tx, f)
+			if err != nil {
+				continue
+			}
+			current[f] = e
+			names = append(names, path.Base(f))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pairs := pairSiblings(names, idx.prefer)
+	var shots []stackShot
+	for f, e := range current {
+		if pairs[path.Base(f)].primary == "" && e.Shot != 0 && e.Body != "" {
+			shots = append(shots, stackShot{f, e})
+		}
+	}
+	sort.Slice(shots, func(i, j int) bool {
+		a, b := shots[i], shots[j]
+		if a.e.Body != b.e.Body {
+			return a.e.Body < b.e.Body
+		}
+		if a.e.Shot != b.e.Shot {
+			return a.e.Shot < b.e.Shot
+		}
+		return a.file < b.file
+	})
+	stacks := stackShots(shots, idx.stackGap)
+
+	changed := make([]string, 0, len(stacks))
+	for f, cur := range current {
+		s, pr := stacks[f], pairs[path.Base(f)]
+		switch {
+		case (s == nil) != (cur.Stack == nil), s != nil && *s != *cur.Stack,
+			pr.primary != cur.Primary, !sameStrings(pr.siblings, cur.Siblings):
+			changed = append(changed, f)
+		}
+	}
+	sort.Strings(changed)
+	for i := 0; i < len(changed); i += reconcileBatch {
+		batch := changed[i:min(i+reconcileBatch, len(changed))]
+		err := idx.update(func(tx *badger.Txn) error {
+			for _, f := range batch {
+				if _, err := tx.Get(dirKey(f, dirFile)); err == badger.ErrKeyNotFound {
+					continue // dropped since
+				}
+				pr := pairs[path.Base(f)]
+				err := updateDirEntry(tx, f, func(e *dirEntry) {
+					e.Stack = stacks[f]
+					e.Primary, e.Siblings = pr.primary, pr.siblings
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(changed) > 0 {
+		idx.log.WithField("dir", dir).WithField("changed", len(changed)).Debug("restacked directory")
+	}
+	return nil
+}
+
+// restack directories as they're marked, until ctx is done. Everything is
+// restacked first if the stack gap or preferred source changed since last time
+func (idx *Indexer) stackLoop(ctx context.Context) {
+	want := grouping{Gap: int64(idx.stackGap / time.Millisecond), Prefer: idx.prefer}
+	var was grouping
+	err := fetchJSON(idx.db, groupingKey, &was)
+	if err == badger.ErrKeyNotFound || (err == nil && was != want) {
+		idx.log.WithField("gap", idx.stackGap).WithField("prefer", idx.prefer).Info("grouping changed, restacking all photos")
+		err = idx.db.View(func(tx *badger.Txn) error {
+			_, dirs := dirTree(tx, "")
+			for _, d := range append(dirs, "") {
+				idx.stacks.mark(d)
+			}
+			return nil
+		})
+		if err == nil {
+			b, _ := json.Marshal(want)
+			err = idx.update(func(tx *badger.Txn) error { return tx.Set(groupingKey, b) })
+		}
+	}
+	if err != nil {
+		idx.log.WithError(err).Error("unable to check stack grouping")
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-idx.stacks.kick:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(stackSettle):
+		}
+		for _, d := range idx.stacks.take() {
+			if err := idx.restack(d); err != nil {
+				idx.log.WithError(err).WithField("dir", d).Error("unable to restack directory")
+			}
+		}
+	}
+}
+
+// whether a file shows in a listing. Siblings only show their preferred
+// source, and collapsed stacks only their cover
+func (lr ListReq) shows(e dirEntry) bool {
+	return e.Primary == "" && (!lr.Collapse || e.Stack == nil || e.Stack.Cover)
+}
+
+// the stack a photo is in, if any
+func (p *Photo) Stack() *StackInfo { return p.dirEntry().Stack }
+
+// the photos of a stack in a directory
+func StackPhotos(ctx context.Context, dir string, id string) ([]Photo, error) {
+	db := ctx.Value("badger").(*badger.DB)
+	photoDir := ctx.Value("photoDir").(string)
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+
+	ps := make([]Photo, 0, 10)
+	err := db.View(func(tx *badger.Txn) error {
+		pfx := dirPrefix(dir, dirFile)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			f, _, err := parseDirKey(it.Item().Key())
+			if err != nil {
+				continue
+			}
+			if e, err := getDirEntry(tx, f); err == nil && e.Stack != nil && e.Stack.ID == id {
+				ps = append(ps, Photo{Src: filepath.Join(photoDir, f), ctx: ctx})
+			}
+		}
+		return nil
+	})
+	return ps, err
+}
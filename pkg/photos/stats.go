@@ -0,0 +1,179 @@
+package photos
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+type StatsReq struct {
+	Path string    // photoDir-relative directory, recursive
+	From time.Time // capture time, inclusive. Zero for no limit
+	To   time.Time // capture time, exclusive. Zero for no limit
+}
+
+type Count struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type Stats struct {
+	Total       int     `json:"total"`
+	Camera      []Count `json:"camera"`
+	Lens        []Count `json:"lens"`
+	FocalLength []Count `json:"focal_length"`
+	Aperture    []Count `json:"aperture"`
+	ISO         []Count `json:"iso"`
+	Shutter     []Count `json:"shutter_speed"`
+	TimeOfDay   []Count `json:"time_of_day"`
+	BadDates    int     `json:"bad_dates"` // capture times that couldn't be read, left out of time of day and date ranges
+}
+
+// focal length bucket edges, mm
+var focalBuckets = []float64{14, 18, 24, 28, 35, 50, 70, 85, 105, 135, 200, 300, 400, 600}
+
+// count gear and exposure settings across the index
+func GetStats(ctx context.Context, sr StatsReq) (Stats, error) {
+	db := ctx.Value("badger").(*badger.DB)
+
+	pathPfx := strings.Trim(sr.Path, "/")
+	if pathPfx != "" {
+		pathPfx += "/"
+	}
+	dated := !sr.From.IsZero() || !sr.To.IsZero()
+
+	var st Stats
+	err := db.View(func(tx *badger.Txn) error {
+		// capture times, for filtering and time of day
+		taken := make(map[string]time.Time)
+		bad := make(map[string]bool)
+		scanField(tx, SourceEXIF, "DateTimeOriginal", func(v string, file string) {
+			if len(v) >= 19 { // past it may be subseconds or a zone
+				if t, err := time.Parse("2006:01:02 15:04:05", v[:19]); err == nil {
+					taken[file] = t
+					return
+				}
+			}
+			bad[file] = true
+		})
+		for f := range bad {
+			if strings.HasPrefix(f, pathPfx) {
+				st.BadDates++
+			}
+		}
+
+		included := make(map[string]bool)
+		pfx := []byte{primaryRecord, SourceEXIF, DataRecord}
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = pfx
+		it := tx.NewIterator(opts)
+		for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+			file := string(it.Item().Key()[3:])
+			if !strings.HasPrefix(file, pathPfx) {
+				continue
+			}
+			if dated {
+				t, ok := taken[file]
+				if !ok || (!sr.From.IsZero() && t.Before(sr.From)) || (!sr.To.IsZero() && !t.Before(sr.To)) {
+					continue
+				}
+			}
+			included[file] = true
+		}
+		it.Close()
+		st.Total = len(included)
+
+		// count a field once per file, taking the first of the fields that has a value
+		count := func(fields []string, label func(string) string) []Count {
+			seen := make(map[string]bool)
+			counts := make(map[string]int)
+			for _, f := range fields {
+				scanField(tx, SourceEXIF, f, func(v string, file string) {
+					if !included[file] || seen[file] {
+						return
+					}
+					if l := label(v); l != "" {
+						seen[file] = true
+						counts[l]++
+					}
+				})
+			}
+			return sortCounts(counts)
+		}
+		same := func(v string) string { return v }
+
+		st.Camera = count([]string{"Model"}, same)
+		st.Lens = count([]string{"LensModel", "LensID", "LensType", "Lens"}, func(v string) string {
+			if strings.HasPrefix(v, "Unknown") || v == "----" {
+				return ""
+			}
+			return v
+		})
+		st.FocalLength = count([]string{"FocalLength"}, focalBucket)
+		st.Aperture = count([]string{"FNumber", "Aperture"}, func(v string) string {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+				return "f/" + strconv.FormatFloat(f, 'f', -1, 64)
+			}
+			return ""
+		})
+		st.ISO = count([]string{"ISO"}, same)
+		st.Shutter = count([]string{"ExposureTime", "ShutterSpeed"}, same)
+
+		hours := make(map[string]int)
+		for f, t := range taken {
+			if included[f] {
+				hours[fmt.Sprintf("%02d", t.Hour())]++
+			}
+		}
+		st.TimeOfDay = sortCounts(hours)
+		sort.SliceStable(st.TimeOfDay, func(i, j int) bool { return st.TimeOfDay[i].Value < st.TimeOfDay[j].Value })
+
+		return nil
+	})
+	return st, err
+}
+
+// call f with the value and file of every index entry for a field
+func scanField(tx *badger.Txn, source byte, field string, f func(string, string)) {
+	scanIdx(tx, idxValuePrefix(source, field, ""), func(e idxEntry) {
+		f(e.Value, e.File)
+	})
+}
+
+// "35.0 mm" -> "35-49mm"
+func focalBucket(v string) string {
+	mm, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(v, "mm")), 64)
+	if err != nil || mm <= 0 {
+		return ""
+	}
+	if mm < focalBuckets[0] {
+		return fmt.Sprintf("<%gmm", focalBuckets[0])
+	}
+	for i := 1; i < len(focalBuckets); i++ {
+		if mm < focalBuckets[i] {
+			return fmt.Sprintf("%g-%gmm", focalBuckets[i-1], focalBuckets[i]-1)
+		}
+	}
+	return fmt.Sprintf("%gmm+", focalBuckets[len(focalBuckets)-1])
+}
+
+// most frequent first
+func sortCounts(m map[string]int) []Count {
+	c := make([]Count, 0, len(m))
+	for v, n := range m {
+		c = append(c, Count{Value: v, Count: n})
+	}
+	sort.SliceStable(c, func(i, j int) bool {
+		if c[i].Count != c[j].Count {
+			return c[i].Count > c[j].Count
+		}
+		return c[i].Value < c[j].Value
+	})
+	return c
+}
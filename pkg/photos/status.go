@@ -0,0 +1,109 @@
+package photos
+
+import (
+	"sync"
+	"time"
+)
+
+// progress of the indexer since startup. Files are counted when queued, and
+// again once done, failed, or skipped for already being up to date
+type IndexStatus struct {
+	Queued  int          `json:"queued"`
+	Done    int          `json:"done"`
+	Failed  int          `json:"failed"`
+	Skipped int          `json:"skipped"`
+	Pending int          `json:"pending"` // queued, not yet finished
+	Errors  []IndexError `json:"errors"`  // most recent last
+	Updated time.Time    `json:"updated"`
+
+	// whether the startup reconcile is done, and listings come from the
+	// index. Why not, while it's being retried
+	Ready          bool   `json:"ready"`
+	ReconcileError string `json:"reconcile_error,omitempty"`
+}
+
+type IndexError struct {
+	File  string    `json:"file"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// how many failures are remembered
+const recentErrors = 50
+
+type statusTracker struct {
+	mu   sync.Mutex
+	s    IndexStatus
+	subs map[chan IndexStatus]struct{}
+}
+
+func (st *statusTracker) queue(n int) { st.change(func(s *IndexStatus) { s.Queued += n }) }
+func (st *statusTracker) done()       { st.change(func(s *IndexStatus) { s.Done++ }) }
+func (st *statusTracker) skip()       { st.change(func(s *IndexStatus) { s.Skipped++ }) }
+
+func (st *statusTracker) reconciled(err error) {
+	st.change(func(s *IndexStatus) {
+		s.Ready, s.ReconcileError = err == nil, ""
+		if err != nil {
+			s.ReconcileError = err.Error()
+		}
+	})
+}
+
+func (st *statusTracker) fail(file string, err error) {
+	st.change(func(s *IndexStatus) {
+		s.Failed++
+		if len(s.Errors) == recentErrors {
+			s.Errors = append(s.Errors[:0], s.Errors[1:]...)
+		}
+		s.Errors = append(s.Errors, IndexError{File: file, Error: err.Error(), Time: time.Now()})
+	})
+}
+
+func (st *statusTracker) change(fn func(s *IndexStatus)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(&st.s)
+	st.s.Pending = st.s.Queued - st.s.Done - st.s.Failed - st.s.Skipped
+	st.s.Updated = time.Now()
+
+	snap := st.snapshot()
+	for c := range st.subs {
+		// subscribers only care about the latest. Replace anything unread
+		select {
+		case <-c:
+		default:
+		}
+		c <- snap
+	}
+}
+
+func (st *statusTracker) get() IndexStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.snapshot()
+}
+
+// copy, with its own error slice. Lock must be held
+func (st *statusTracker) snapshot() IndexStatus {
+	s := st.s
+	s.Errors = append(make([]IndexError, 0, len(st.s.Errors)), st.s.Errors...)
+	return s
+}
+
+func (st *statusTracker) subscribe() chan IndexStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.subs == nil {
+		st.subs = make(map[chan IndexStatus]struct{})
+	}
+	c := make(chan IndexStatus, 1)
+	st.subs[c] = struct{}{}
+	return c
+}
+
+func (st *statusTracker) unsubscribe(c chan IndexStatus) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.subs, c)
+}
@@ -0,0 +1,219 @@
+package photos
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pzl/mstk/logger"
+)
+
+/*
+	Full-text search.
+
+	Words are lowercased runs of letters and digits, no stemming. Each
+	word of a file is stored once, with the weight of the most important
+	field it was found in. Searching matches every query word as a prefix,
+	and a photo must match them all. Exact word matches count double.
+*/
+
+// index fields that are searchable, and how much a match counts
+var textFields = map[string]byte{
+	"title":       6,
+	"description": 4,
+	"tags":        4,
+	"loc.city":    3,
+	"loc.region":  3,
+	"loc.country": 3,
+	"Make":        2,
+	"Model":       2,
+	"LensModel":   2,
+	"LensID":      2,
+	"LensType":    2,
+	"Lens":        2,
+}
+
+const (
+	folderWeight = 3
+	nameWeight   = 1
+)
+
+// words to index for a source of a file, and their weights
+func textEntries(source byte, file string, fields [][2]string) map[string]byte {
+	words := make(map[string]byte)
+	add := func(s string, weight byte) {
+		for _, w := range tokenize(s) {
+			if weight > words[w] {
+				words[w] = weight
+			}
+		}
+	}
+	for _, f := range fields {
+		weight, ok := textFields[f[0]]
+		if !ok {
+			continue
+		}
+		if f[0] == "tags" && strings.HasPrefix(f[1], "darktable|") {
+			continue // darktable's own bookkeeping tags
+		}
+		add(f[1], weight)
+	}
+
+	// every file has EXIF, so the path goes with it
+	if source == SourceEXIF {
+		add(path.Dir(file), folderWeight)
+		add(strings.TrimSuffix(path.Base(file), path.Ext(file)), nameWeight)
+	}
+	return words
+}
+
+// lowercase words, split on anything not a letter or digit. Single
+// letters are dropped
+func tokenize(s string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	words := fields[:0]
+	for _, f := range fields {
+		if len(f) > 1 || (len(f) == 1 && unicode.IsDigit(rune(f[0]))) {
+			words = append(words, f)
+		}
+	}
+	return words
+}
+
+// ranked photos matching every word of q
+func TextSearch(ctx context.Context, q string, offset int, count int) (SearchResults, error) {
+	log := logger.LogFromCtx(ctx)
+	db := ctx.Value("badger").(*badger.DB)
+	photoDir := ctx.Value("photoDir").(string)
+
+	words := tokenize(q)
+	if len(words) == 0 {
+		return SearchResults{Results: []SearchResult{}}, nil
+	}
+
+	var scores map[string]int
+	err := db.View(func(tx *badger.Txn) error {
+		for i, w := range words {
+			// best match of this word, per file
+			best := make(map[string]int)
+			pfx := textPrefix(w)
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = pfx
+			it := tx.NewIterator(opts)
+			for it.Seek(pfx); it.ValidForPrefix(pfx); it.Next() {
+				token, file, err := parseTextKey(it.Item().Key())
+				if err != nil {
+					continue
+				}
+				if i > 0 {
+					if _, ok := scores[file]; !ok {
+						continue
+					}
+				}
+				var s int
+				if err := it.Item().Value(func(v []byte) error {
+					if len(v) == 1 {
+						s = int(v[0])
+					}
+					return nil
+				}); err != nil {
+					it.Close()
+					return err
+				}
+				if token == w {
+					s *= 2
+				}
+				if s > best[file] {
+					best[file] = s
+				}
+			}
+			it.Close()
+
+			if i == 0 {
+				scores = best
+				continue
+			}
+			for f := range scores {
+				if b, ok := best[f]; ok {
+					scores[f] += b
+				} else {
+					delete(scores, f)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return SearchResults{}, err
+	}
+
+	files := make([]string, 0, len(scores))
+	for f := range scores {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if scores[files[i]] != scores[files[j]] {
+			return scores[files[i]] > scores[files[j]]
+		}
+		return files[i] < files[j]
+	})
+
+	if offset < 0 {
+		offset = 0
+	}
+	if count <= 0 {
+		count = 30
+	}
+	results := SearchResults{
+		Total:   len(files),
+		Results: make([]SearchResult, 0, count),
+	}
+	for _, f := range files[min(offset, len(files)):min(offset+count, len(files))] {
+		p, err := FromSrc(ctx, filepath.Join(photoDir, f))
+		if err != nil {
+			log.WithError(err).Error("error converting index result to photo")
+			continue
+		}
+		results.Results = append(results.Results, SearchResult{
+			Score:   scores[f],
+			Matches: highlight(f, words),
+			Str:     f,
+			Photo:   p,
+		})
+	}
+	return results, nil
+}
+
+// positions in s of the query words, for showing what matched. Paths
+// are only one of the things searched, so this may well be empty
+func highlight(s string, words []string) []int {
+	ls := strings.ToLower(s)
+	if len(ls) != len(s) {
+		return []int{} // lowercasing moved things around
+	}
+	seen := make(map[int]struct{})
+	for _, w := range words {
+		for i := 0; i < len(ls); {
+			j := strings.Index(ls[i:], w)
+			if j == -1 {
+				break
+			}
+			for k := i + j; k < i+j+len(w); k++ {
+				seen[k] = struct{}{}
+			}
+			i += j + len(w)
+		}
+	}
+	m := make([]int, 0, len(seen))
+	for i := range seen {
+		m = append(m, i)
+	}
+	sort.Ints(m)
+	return m
+}
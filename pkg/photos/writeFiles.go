@@ -0,0 +1,89 @@
+package photos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+)
+
+// a minimal sidecar, for photos darktable hasn't made one for yet
+const xmpTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/" x:xmptk="XMP Core 4.4.0-Exiv2">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmp:Rating="0">
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+`
+
+var (
+	rdfDescription = regexp.MustCompile(`<rdf:Description\b[^>]*>`)
+	xmpGPSAttr     = regexp.MustCompile(`\s+exif:GPS(Latitude|Longitude|Altitude|AltitudeRef|VersionID)="[^"]*"`)
+)
+
+// write GPS coordinates into an XMP sidecar, creating it if needed. Absolute path expected.
+//
+// Edits the attributes in place rather than re-serializing, so the rest of
+// darktable's sidecar is left exactly as it was.
+func WriteXMPLocation(file string, lat float64, lon float64, alt *float64) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		data = []byte(xmpTemplate)
+	} else if err != nil {
+		return err
+	}
+
+	loc := rdfDescription.FindIndex(data)
+	if loc == nil {
+		return errors.New("no rdf:Description in XMP file " + file)
+	}
+
+	tag := xmpGPSAttr.ReplaceAll(data[loc[0]:loc[1]], nil)
+	end := len(tag) - 1 // position of closing '>'
+	if tag[end-1] == '/' {
+		end--
+	}
+
+	var attrs bytes.Buffer
+	if !bytes.Contains(tag, []byte("xmlns:exif=")) {
+		attrs.WriteString("\n    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"")
+	}
+	fmt.Fprintf(&attrs, "\n    exif:GPSVersionID=\"2.2.0.0\"")
+	fmt.Fprintf(&attrs, "\n    exif:GPSLatitude=\"%s\"", xmpCoord(lat, 'N', 'S'))
+	fmt.Fprintf(&attrs, "\n    exif:GPSLongitude=\"%s\"", xmpCoord(lon, 'E', 'W'))
+	if alt != nil {
+		ref := 0
+		if *alt < 0 {
+			ref = 1
+		}
+		fmt.Fprintf(&attrs, "\n    exif:GPSAltitude=\"%d/100\"", int64(math.Round(math.Abs(*alt)*100)))
+		fmt.Fprintf(&attrs, "\n    exif:GPSAltitudeRef=\"%d\"", ref)
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:loc[0]])
+	out.Write(tag[:end])
+	out.Write(attrs.Bytes())
+	out.Write(tag[end:])
+	out.Write(data[loc[1]:])
+
+	return ioutil.WriteFile(file, out.Bytes(), 0644)
+}
+
+// XMP's DDD,MM.mmmmmmK coordinate format
+func xmpCoord(v float64, pos byte, neg byte) string {
+	ref := pos
+	if v < 0 {
+		ref = neg
+		v = -v
+	}
+	deg := math.Floor(v)
+	return fmt.Sprintf("%d,%.6f%c", int(deg), (v-deg)*60, ref)
+}
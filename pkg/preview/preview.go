@@ -0,0 +1,254 @@
+package preview
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/jpeg" // decoding preview dimensions
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/pzl/phumpkin/pkg/formats"
+)
+
+/*
+	Images embedded in photo files.
+
+	Raw files carry a few JPEGs a camera made of them, at different sizes.
+	They're found and read with exiftool, and are quick to get at, for
+	thumbnails or anything else that doesn't need darktable.
+*/
+
+// embedded JPEG tags to look in, most raw formats use some of these, with
+// the tags exiftool gives their place in the file by
+type previewTag struct {
+	name   string
+	start  string
+	length string
+}
+
+var previewTags = []previewTag{
+	{"ThumbnailImage", "ThumbnailOffset", "ThumbnailLength"},
+	{"PreviewImage", "PreviewImageStart", "PreviewImageLength"},
+	{"JpgFromRaw", "JpgFromRawStart", "JpgFromRawLength"},
+	{"OtherImage", "OtherImageStart", "OtherImageLength"},
+}
+
+// an image embedded in a raw file
+type Preview struct {
+	Tag    string `json:"tag"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+/*
+	Preview cache layout. cache is a path unique to the source, under the thumb dir:
+
+		<cache>.json        list of embedded previews and their dimensions
+		<cache>.<Tag>.jpg   extracted preview, once it has been used
+*/
+
+// list the previews embedded in src, smallest first. Cached if cache is not ""
+func List(src string, cache string) ([]Preview, error) {
+	ps, _, err := previews(src, cache)
+	return ps, err
+}
+
+// list of previews, and their data if they had to be extracted to get it
+func previews(src string, cache string) ([]Preview, map[string][]byte, error) {
+	if cache != "" && fresh(src, cache+".json") {
+		var ps []Preview
+		if data, err := ioutil.ReadFile(cache + ".json"); err == nil {
+			if err := json.Unmarshal(data, &ps); err == nil {
+				return ps, nil, nil
+			}
+		}
+	}
+
+	ps, images, err := extractPreviews(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cache != "" {
+		if err := os.MkdirAll(filepath.Dir(cache), 0755); err != nil {
+			return nil, nil, err
+		}
+		if data, err := json.Marshal(ps); err == nil {
+			ioutil.WriteFile(cache+".json", data, 0644) // nolint
+		}
+	}
+	return ps, images, nil
+}
+
+// smallest preview with its long edge at least px. The largest one if none are
+// big enough, or px is 0 (full size)
+func choosePreview(ps []Preview, px int) (Preview, bool) {
+	if len(ps) == 0 {
+		return Preview{}, false
+	}
+	if px > 0 {
+		for _, p := range ps {
+			if max(p.Width, p.Height) >= px {
+				return p, true
+			}
+		}
+	}
+	return ps[len(ps)-1], true
+}
+
+// image data of the best preview in src for a px size. Only the
+// previews actually used are kept in the cache
+func Best(src string, px int, cache string) ([]byte, error) {
+	ps, images, err := previews(src, cache)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := choosePreview(ps, px)
+	if !ok {
+		return nil, errors.New("no embedded preview in " + src)
+	}
+
+	f := cache + "." + p.Tag + ".jpg"
+	b, extracted := images[p.Tag]
+	if !extracted {
+		if cache != "" && fresh(src, f) {
+			if b, err := ioutil.ReadFile(f); err == nil {
+				return b, nil
+			}
+		}
+		if b, err = Extract(src, p.Tag); err != nil {
+			return nil, err
+		}
+	}
+	if cache != "" {
+		ioutil.WriteFile(f, b, 0644) // nolint
+	}
+	return b, nil
+}
+
+// list the previews embedded in src. Their dimensions are read from their
+// headers in place where exiftool says where they are, and only previews
+// it can't place are extracted, and returned
+func extractPreviews(src string) ([]Preview, map[string][]byte, error) {
+	args := []string{"-j", "-n"}
+	for _, t := range previewTags {
+		args = append(args, "-"+t.name, "-"+t.start, "-"+t.length)
+	}
+	args = append(args, src)
+
+	out, err := exec.Command("exiftool", args...).Output()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var j []map[string]interface{}
+	if err := json.Unmarshal(out, &j); err != nil {
+		return nil, nil, err
+	}
+	if len(j) == 0 {
+		return nil, nil, errors.New("unable to parse exiftool output")
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	ps := make([]Preview, 0, len(previewTags))
+	images := make(map[string][]byte)
+	for _, t := range previewTags {
+		if _, ok := j[0][t.name]; !ok {
+			continue
+		}
+		start, _ := j[0][t.start].(float64)
+		length, _ := j[0][t.length].(float64)
+		var cfg image.Config
+		err := errors.New("not placed")
+		if start > 0 && length > 0 {
+			cfg, _, err = image.DecodeConfig(io.NewSectionReader(f, int64(start), int64(length)))
+		}
+		if err != nil { // somewhere exiftool can't say, or not where it said
+			b, xerr := Extract(src, t.name)
+			if xerr != nil {
+				continue
+			}
+			if cfg, _, err = image.DecodeConfig(bytes.NewReader(b)); err != nil {
+				continue // not an image we can use
+			}
+			images[t.name] = b
+		}
+		ps = append(ps, Preview{Tag: t.name, Width: cfg.Width, Height: cfg.Height})
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].Width*ps[i].Height < ps[j].Width*ps[j].Height })
+	return ps, images, nil
+}
+
+// whether a cache file exists, and is newer than the source
+func fresh(src string, cached string) bool {
+	ci, err := os.Stat(cached)
+	if err != nil {
+		return false
+	}
+	si, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	return ci.ModTime().After(si.ModTime())
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// the smallest embedded image in src with its long edge at least px, for
+// looking at rather than showing. Formats read whole are, without any
+func Small(src string, px int, cache string) ([]byte, error) {
+	b, err := Best(src, px, cache)
+	if err != nil && formats.ThumbOf(src) == formats.ThumbDecode {
+		return ioutil.ReadFile(src)
+	}
+	return b, err
+}
+
+// extract one embedded image by tag
+func Extract(src string, tag string) ([]byte, error) {
+	c := exec.Command("exiftool", "-b", "-"+tag, src)
+	sout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	serr, err := c.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	output, err := ioutil.ReadAll(sout)
+	if err != nil {
+		return nil, err
+	}
+	errput, err := ioutil.ReadAll(serr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Wait(); err != nil {
+		return nil, err
+	}
+
+	if len(errput) > 0 {
+		return nil, errors.New(string(errput))
+	}
+
+	return output, nil
+}
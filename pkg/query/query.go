@@ -0,0 +1,279 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	Metadata query language.
+
+		rating>=3 AND tags:"Places|Portugal" AND (exif.Model:"ILCE-7M3" OR label:red) NOT history:liquify
+
+	expr    := or
+	or      := and { OR and }
+	and     := unary { [AND] unary }        terms side by side are ANDed
+	unary   := NOT unary | -unary | primary
+	primary := ( expr ) | term
+	term    := field op value
+	op      := : = != > >= < <=
+
+	Keywords are case-insensitive. Values may be quoted to include spaces,
+	parentheses or operators; a trailing * on an unquoted value matches
+	by prefix. What fields mean is up to whoever runs the query.
+*/
+
+type Node interface {
+	String() string
+}
+
+type And struct{ L, R Node }
+type Or struct{ L, R Node }
+type Not struct{ X Node }
+
+type Term struct {
+	Field  string
+	Op     Op
+	Value  string
+	Prefix bool // value ended in an unquoted *
+}
+
+type Op string
+
+const (
+	Eq  Op = ":"
+	Ne  Op = "!="
+	Gt  Op = ">"
+	Gte Op = ">="
+	Lt  Op = "<"
+	Lte Op = "<="
+)
+
+func (n And) String() string { return "(" + n.L.String() + " AND " + n.R.String() + ")" }
+func (n Or) String() string  { return "(" + n.L.String() + " OR " + n.R.String() + ")" }
+func (n Not) String() string { return "NOT " + n.X.String() }
+func (t Term) String() string {
+	v := fmt.Sprintf("%q", t.Value)
+	if t.Prefix {
+		v = t.Value + "*"
+	}
+	return t.Field + string(t.Op) + v
+}
+
+type Error struct {
+	Pos int // byte offset into the query
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("query: %s at %d", e.Msg, e.Pos) }
+
+func Parse(q string) (Node, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{toks: toks}
+	if p.peek().kind == tEOF {
+		return nil, &Error{Pos: 0, Msg: "empty query"}
+	}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return n, nil
+}
+
+/* ---- parser ---- */
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) or() (Node, error) {
+	n, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tOr {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		n = Or{n, r}
+	}
+	return n, nil
+}
+
+func (p *parser) and() (Node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tAnd:
+			p.next()
+		case tNot, tLParen, tWord:
+			// implicit AND
+		default:
+			return n, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n = And{n, r}
+	}
+}
+
+func (p *parser) unary() (Node, error) {
+	if p.peek().kind == tNot {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Node, error) {
+	t := p.next()
+	switch t.kind {
+	case tLParen:
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tRParen {
+			return nil, &Error{Pos: c.pos, Msg: "expected )"}
+		}
+		return n, nil
+	case tWord:
+		op := p.next()
+		if op.kind != tOp {
+			return nil, &Error{Pos: op.pos, Msg: fmt.Sprintf("expected operator after %q", t.text)}
+		}
+		v := p.next()
+		if v.kind == tAnd || v.kind == tOr || v.kind == tNot {
+			v.kind = tWord // keywords are only keywords between terms
+		}
+		if v.kind != tWord && v.kind != tString {
+			return nil, &Error{Pos: v.pos, Msg: fmt.Sprintf("expected value after %s%s", t.text, op.text)}
+		}
+		term := Term{Field: t.text, Op: Op(op.text), Value: v.text}
+		if term.Op == "=" {
+			term.Op = Eq
+		}
+		if v.kind == tWord && strings.HasSuffix(v.text, "*") {
+			term.Value = strings.TrimSuffix(v.text, "*")
+			term.Prefix = true
+		}
+		return term, nil
+	case tEOF:
+		return nil, &Error{Pos: t.pos, Msg: "unexpected end of query"}
+	default:
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+}
+
+/* ---- lexer ---- */
+
+type tokKind int
+
+const (
+	tEOF tokKind = iota
+	tWord
+	tString
+	tOp
+	tAnd
+	tOr
+	tNot
+	tLParen
+	tRParen
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func lex(q string) ([]token, error) {
+	toks := make([]token, 0, 16)
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, token{tLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tRParen, ")", i})
+			i++
+		case c == '"':
+			var b strings.Builder
+			start := i
+			i++
+			for ; i < len(q) && q[i] != '"'; i++ {
+				if q[i] == '\\' && i+1 < len(q) {
+					i++
+				}
+				b.WriteByte(q[i])
+			}
+			if i >= len(q) {
+				return nil, &Error{Pos: start, Msg: "unterminated string"}
+			}
+			i++
+			toks = append(toks, token{tString, b.String(), start})
+		case strings.IndexByte(":=!<>", c) != -1:
+			start := i
+			i++
+			if i < len(q) && q[i] == '=' && c != ':' && c != '=' {
+				i++
+			}
+			op := q[start:i]
+			if op == "!" {
+				return nil, &Error{Pos: start, Msg: "expected !="}
+			}
+			toks = append(toks, token{tOp, op, start})
+		case c == '-' && (len(toks) == 0 || toks[len(toks)-1].kind != tOp):
+			toks = append(toks, token{tNot, "-", i})
+			i++
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(" \t\n\r()\":=!<>", rune(q[i])) {
+				i++
+			}
+			w := q[start:i]
+			kind := tWord
+			switch strings.ToUpper(w) {
+			case "AND":
+				kind = tAnd
+			case "OR":
+				kind = tOr
+			case "NOT":
+				kind = tNot
+			}
+			toks = append(toks, token{kind, w, start})
+		}
+	}
+	return append(toks, token{tEOF, "", len(q)}), nil
+}
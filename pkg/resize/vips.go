@@ -1,27 +1,34 @@
 package resize
 
 import (
+	"bytes"
 	"errors"
+	"image/jpeg"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"strings"
 
 	"github.com/DAddYE/vips"
+	"github.com/pzl/phumpkin/pkg/formats"
+	"github.com/pzl/phumpkin/pkg/orientation"
+	"github.com/pzl/phumpkin/pkg/preview"
 )
 
-func Quick(src string, dest string, px int) error {
+// resize without darktable. Raw sources use the best embedded preview for
+// the size, cached under cache ("" to not cache). The result is turned upright
+// according to o, which should be Normal if src is already upright
+func Quick(src string, dest string, px int, cache string, o orientation.Orientation) error {
 	var in []byte
 	var err error
 
-	ext := strings.ToLower(path.Ext(src))
-	switch ext {
-	case ".jpg", ".jpeg":
-		in, err = fromjpg(src)
+	switch formats.ThumbOf(src) {
+	case formats.ThumbDecode:
+		in, err = fromFile(src)
+	case formats.ThumbRender:
+		return errors.New("needs darktable: " + path.Base(src))
 	default:
-		in, err = fromexif(src)
+		in, err = preview.Best(src, px, cache)
 	}
 	if err != nil {
 		return err
@@ -38,43 +45,30 @@ func Quick(src string, dest string, px int) error {
 		return err
 	}
 
+	// vips doesn't rotate for us
+	if buf, err = orient(buf, o); err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 		return err
 	}
 	return ioutil.WriteFile(dest, buf, 0644)
 }
 
-func fromjpg(src string) ([]byte, error) { return ioutil.ReadFile(src) }
-
-func fromexif(src string) ([]byte, error) {
-	c := exec.Command("exiftool", "-b", "-ThumbnailImage", src)
-	sout, err := c.StdoutPipe()
-	if err != nil {
-		return nil, err
+func orient(buf []byte, o orientation.Orientation) ([]byte, error) {
+	if o <= orientation.Normal || o > orientation.Rot270 {
+		return buf, nil
 	}
-	serr, err := c.StderrPipe()
+	img, err := jpeg.Decode(bytes.NewReader(buf))
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Start(); err != nil {
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, o.Apply(img), &jpeg.Options{Quality: 60}); err != nil {
 		return nil, err
 	}
-	output, err := ioutil.ReadAll(sout)
-	if err != nil {
-		return nil, err
-	}
-	errput, err := ioutil.ReadAll(serr)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := c.Wait(); err != nil {
-		return nil, err
-	}
-
-	if len(errput) > 0 {
-		return nil, errors.New(string(errput))
-	}
-
-	return output, nil
+	return out.Bytes(), nil
 }
+
+func fromFile(src string) ([]byte, error) { return ioutil.ReadFile(src) }
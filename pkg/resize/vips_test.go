@@ -0,0 +1,52 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/pzl/phumpkin/pkg/orientation"
+)
+
+func testJPEG(t *testing.T, w int, h int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOrientUnchanged(t *testing.T) {
+	in := testJPEG(t, 20, 30)
+	for _, o := range []orientation.Orientation{orientation.Invalid, orientation.Normal, 9} {
+		out, err := orient(in, o)
+		if err != nil {
+			t.Fatalf("%d: %v", o, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%d: image was re-encoded", o)
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	in := testJPEG(t, 20, 30)
+	for o := orientation.MirrorHoriz; o <= orientation.Rot270; o++ {
+		out, err := orient(in, o)
+		if err != nil {
+			t.Fatalf("%v: %v", o, err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%v: %v", o, err)
+		}
+		w, h := 20, 30
+		if o.SwapsDimensions() {
+			w, h = h, w
+		}
+		if cfg.Width != w || cfg.Height != h {
+			t.Errorf("%v: got %dx%d, want %dx%d", o, cfg.Width, cfg.Height, w, h)
+		}
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"strings"
 
 	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/formats"
+	"github.com/pzl/phumpkin/pkg/orientation"
 	"github.com/pzl/phumpkin/pkg/photos"
 	"github.com/pzl/phumpkin/pkg/resize"
 	"github.com/saracen/walker"
@@ -23,19 +25,27 @@ type Action struct {
 }
 
 type ListReq struct {
-	Offset int
-	Count  int
-	Sort   string
-	Asc    bool
-	Path   string
+	Offset   int
+	Count    int
+	Sort     string
+	Asc      bool
+	Path     string
+	Cursor   string
+	Collapse bool
 }
 
 // @todo: duplicates by XMP
 // primary may be <IMG>.ARW.xmp and dupe may be <IMG>_nn.ARW.XMP
-func (a Action) List(ctx context.Context, lr ListReq) ([]photos.Photo, []string, error) {
+// returns a cursor for the next page when listed from the index
+func (a Action) List(ctx context.Context, lr ListReq) ([]photos.Photo, []string, string, error) {
 	log := logger.LogFromCtx(ctx)
 	photoDir := ctx.Value("photoDir").(string)
 
+	if ps, dirs, next, ok, err := a.s.mgr.List(ctx, photos.ListReq(lr)); ok {
+		return ps, dirs, next, err
+	}
+	log.WithField("path", lr.Path).Debug("directory not indexed, listing from disk")
+
 	// receiving channels
 	rcvPhoto := make(chan photos.Photo)
 	rcvDir := make(chan string)
@@ -70,7 +80,10 @@ func (a Action) List(ctx context.Context, lr ListReq) ([]photos.Photo, []string,
 		if name == searchPath {
 			return nil
 		}
-		if strings.HasSuffix(name, ".xmp") {
+		if a.s.mgr.Skips(strings.TrimPrefix(name, photoDir+"/"), fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 		if fi.IsDir() {
@@ -94,15 +107,15 @@ func (a Action) List(ctx context.Context, lr ListReq) ([]photos.Photo, []string,
 	close(rcvPhoto)
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	<-done // wait for dirs loop
 	<-done // wait for photos loop
 
-	ps := PhotoSort(lr.Sort, lr.Asc, lr.Count, lr.Offset, files)
+	ps := PhotoSort(lr.Sort, lr.Asc, lr.Count, lr.Offset, a.s.mgr.DropSiblings(files))
 	sort.Strings(dirs)
-	return ps, dirs, nil
+	return ps, dirs, "", nil
 }
 
 type SizeReq struct {
@@ -117,8 +130,9 @@ func (a Action) GetSize(ctx context.Context, sr SizeReq) (string, error) {
 	photoDir := ctx.Value("photoDir").(string)
 	thumbDir := ctx.Value("thumbDir").(string)
 
+	sr.File = a.s.mgr.Primary(sr.File) // siblings share a thumb, made from the preferred source
 	filepath := photoDir + "/" + sr.File
-	thumbpath := thumbDir + "/" + sr.Size.String() + "/" + thumbExt(sr.File)
+	thumbpath := thumbDir + "/" + sr.Size.String() + "/" + formats.ThumbName(sr.File)
 
 	log.WithFields(logrus.Fields{
 		"size": sr.Size,
@@ -149,7 +163,7 @@ func (a Action) GetSize(ctx context.Context, sr SizeReq) (string, error) {
 				if sr.Size >= s { // skip anything smaller than request
 					continue
 				}
-				bigthumb := thumbDir + "/" + s.String() + "/" + thumbExt(sr.File)
+				bigthumb := thumbDir + "/" + s.String() + "/" + formats.ThumbName(sr.File)
 				if ti, err := os.Stat(bigthumb); err == nil {
 					if ti.ModTime().After(lastMod) {
 						src = bigthumb
@@ -159,11 +173,18 @@ func (a Action) GetSize(ctx context.Context, sr SizeReq) (string, error) {
 			}
 		}
 
-		if sr.Size == photos.SizeXS || src != filepath {
+		if src != filepath || (sr.Size == photos.SizeXS && formats.ThumbOf(src) != formats.ThumbRender) {
 			// quick trickery using vips
 
 			l.Trace("resizing with vips")
-			if err := resize.Quick(src, thumbpath, sr.Size.Int()); err != nil {
+			// larger thumbs are already upright, originals need rotating
+			var cache string
+			o := orientation.Normal
+			if src == filepath {
+				cache = thumbDir + "/preview/" + sr.File
+				o = p.Orientation()
+			}
+			if err := resize.Quick(src, thumbpath, sr.Size.Int(), cache, o); err != nil {
 				l.WithField("src", src).WithField("dest", thumbpath).WithError(err).Error("error resizing with vips")
 				return "", err
 			}
@@ -210,7 +231,7 @@ func (a Action) GetSize(ctx context.Context, sr SizeReq) (string, error) {
 	l.Debug("sending thumb file")
 
 	if !sr.B64 {
-		return "http://" + gethost(ctx) + "/api/v1/thumb/" + sr.Size.String() + "/" + thumbExt(sr.File), nil
+		return "http://" + gethost(ctx) + "/api/v1/thumb/" + sr.Size.String() + "/" + formats.ThumbName(sr.File), nil
 	}
 
 	// read into b64
@@ -249,6 +270,12 @@ func PhotoSort(sortby string, asc bool, count int, offset int, ps []photos.Photo
 			} else {
 				return ps[i].MetaInt("Rating") > ps[j].MetaInt("Rating")
 			}
+		case "modified":
+			if asc {
+				return ps[i].ModTime().Before(ps[j].ModTime())
+			} else {
+				return ps[i].ModTime().After(ps[j].ModTime())
+			}
 		}
 
 		return false
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/photos"
+)
+
+type AdminHandler struct {
+	s *server
+}
+
+// stream a backup of the live database. ?since= a previous backup's version
+// for only what changed after it. This backup's version is sent in the
+// X-Backup-Version trailer
+func (ah *AdminHandler) Backup(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if sv := r.URL.Query().Get("since"); sv != "" {
+		v, err := strconv.ParseUint(sv, 10, 64)
+		if err != nil {
+			writeFail(w, http.StatusBadRequest, "since expected to be a backup version")
+			return
+		}
+		since = v
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=phumpkin-"+time.Now().Format("20060102-150405")+".bak")
+	w.Header().Set("Trailer", "X-Backup-Version")
+	v, err := photos.Backup(r.Context(), w, since)
+	if err != nil {
+		// headers are gone by now, all that's left is cutting it short
+		logger.GetLog(r).WithError(err).Error("error writing backup")
+		return
+	}
+	w.Header().Set("X-Backup-Version", strconv.FormatUint(v, 10))
+}
+
+// replace the database with the backup in the request body, sent as
+// application/octet-stream. The index is then reconciled with the photo
+// directory in the background
+func (ah *AdminHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		writeFail(w, http.StatusUnsupportedMediaType, "backup expected as application/octet-stream")
+		return
+	}
+	if err := ah.s.mgr.Restore(r.Body); err != nil {
+		logger.GetLog(r).WithError(err).Error("error restoring backup")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, ah.s.mgr.Status())
+}
+
+// every photo's EXIF and XMP records, as JSON lines
+func (ah *AdminHandler) Export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if _, err := photos.Export(r.Context(), w); err != nil {
+		logger.GetLog(r).WithError(err).Error("error exporting records")
+	}
+}
+
+// database size, and the last garbage collection pass
+func (ah *AdminHandler) DBStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, ah.s.maint.Status())
+}
+
+// run a garbage collection pass now. Waits for it to finish
+func (ah *AdminHandler) DBCollect(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, ah.s.maint.Run())
+}
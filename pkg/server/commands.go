@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/pzl/phumpkin/pkg/photos"
+)
+
+/*
+	Offline commands. These open the database directly, so the server
+	must not be running against the same DataDir.
+*/
+
+func (s *server) Geotag(ctx context.Context, req photos.GeotagReq) ([]photos.GeotagMatch, error) {
+	c, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.db.Close()
+
+	if err := s.mgr.Open(c); err != nil {
+		return nil, err
+	}
+	return s.mgr.Geotag(c, req)
+}
+
+// write a backup of the database, see photos.Backup
+func (s *server) Backup(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	c, err := s.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer s.db.Close()
+
+	return photos.Backup(c, w, since)
+}
+
+// replace the database with a backup
+func (s *server) Restore(ctx context.Context, r io.Reader) error {
+	c, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	if err := s.mgr.Open(c); err != nil {
+		return err
+	}
+	return s.mgr.Restore(r)
+}
+
+// write photo records as JSON lines, see photos.Export
+func (s *server) Export(ctx context.Context, w io.Writer) (int, error) {
+	c, err := s.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer s.db.Close()
+
+	return photos.Export(c, w)
+}
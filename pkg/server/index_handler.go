@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/pzl/mstk/logger"
+)
+
+type IndexHandler struct {
+	s *server
+}
+
+// check the whole index against the photo directory, and fix what differs
+func (ih *IndexHandler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	res, err := ih.s.mgr.Reconcile(r.Context())
+	if err != nil {
+		logger.GetLog(r).WithError(err).Error("error reconciling index")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, res)
+}
+
+func (ih *IndexHandler) Status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, ih.s.mgr.Status())
+}
+
+// index a file or directory tree, ?path= relative to photoDir. ?force=1
+// re-reads files even if they're up to date
+func (ih *IndexHandler) Reindex(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	if err := ih.s.mgr.Reindex(path, force); err != nil {
+		if os.IsNotExist(err) {
+			writeFail(w, http.StatusNotFound, "path not found")
+			return
+		}
+		logger.GetLog(r).WithError(err).Error("error starting reindex")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, ih.s.mgr.Status())
+}
@@ -8,9 +8,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/formats"
 	"github.com/pzl/phumpkin/pkg/photos"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
@@ -38,21 +40,28 @@ func (ph *PhotoHandler) List(w http.ResponseWriter, r *http.Request) {
 	if asc := r.URL.Query().Get("sort_dir"); asc == "desc" {
 		ascending = false
 	}
-	ps, dirs, err := ph.s.actions.List(r.Context(), ListReq{
-		Offset: offset,
-		Count:  count,
-		Asc:    ascending,
-		Sort:   r.URL.Query().Get("sort"),
-		Path:   r.URL.Query().Get("path"),
+	collapse, _ := strconv.ParseBool(r.URL.Query().Get("collapse"))
+	ps, dirs, next, err := ph.s.actions.List(r.Context(), ListReq{
+		Offset:   offset,
+		Count:    count,
+		Asc:      ascending,
+		Sort:     r.URL.Query().Get("sort"),
+		Path:     r.URL.Query().Get("path"),
+		Cursor:   r.URL.Query().Get("cursor"),
+		Collapse: collapse,
 	})
-	if err != nil {
+	if err == photos.ErrBadCursor {
+		writeFail(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
 		writeErr(w, http.StatusInternalServerError, err)
 		return
 	}
 	writeJSON(w, r, struct {
 		Photos []photos.Photo `json:"photos"`
 		Dirs   []string       `json:"dirs"`
-	}{ps, dirs})
+		Next   string         `json:"next,omitempty"`
+	}{ps, dirs, next})
 }
 
 func (ph *PhotoHandler) Get(w http.ResponseWriter, r *http.Request) {
@@ -77,25 +86,33 @@ func (ph *PhotoHandler) GetThumb(w http.ResponseWriter, r *http.Request) {
 	size := photos.ParseSize(chi.URLParam(r, "size"))
 	path := chi.URLParam(r, "*")
 
-	// look for original file
-	search := photoDir + "/" + strings.Replace(path, ".jpg", ".*", -1)
-	matches, err := filepath.Glob(search)
+	// look for original file. RAW+JPEG siblings share a thumb, made from
+	// the preferred source
+	base := photoDir + "/" + strings.TrimSuffix(path, filepath.Ext(path))
+	search := base + ".*"
+	found, err := filepath.Glob(search)
 	log.WithField("search", search).Debug("searching for original file")
 	if err != nil {
 		log.WithError(err).Error("error looking for original for thumb")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	matches := make([]string, 0, len(found))
+	for _, m := range found {
+		if formats.Supported(m) && strings.TrimSuffix(m, filepath.Ext(m)) == base {
+			matches = append(matches, m)
+		}
+	}
 	if len(matches) == 0 {
 		log.Debug("original file not found, returning 404")
 		http.NotFound(w, r)
 		return
 	}
-	if len(matches) > 2 {
-		log.WithField("matches", matches).Warnf("found %d source matches!", len(matches))
+	if len(matches) > 1 {
+		log.WithField("matches", matches).Debug("found siblings, using preferred source")
 	}
 	s := SizeReq{
-		File:    strings.TrimPrefix(matches[0], photoDir+"/"),
+		File:    strings.TrimPrefix(ph.s.mgr.PickSource(matches), photoDir+"/"),
 		Size:    size,
 		B64:     false,
 		Purpose: r.URL.Query().Get("purpose"),
@@ -112,6 +129,89 @@ func (ph *PhotoHandler) GetThumb(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, fp)
 }
 
+// a file the server may read for a client: in the photo or data directory,
+// links followed. Relative paths are to the photo directory
+func (s *server) libraryFile(p string) (string, bool) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(s.photoDir, p)
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", false
+	}
+	for _, root := range []string{s.photoDir, s.dataDir} {
+		if root == "" {
+			continue
+		}
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+		if rel, err := filepath.Rel(root, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return resolved, true
+		}
+	}
+	return "", false
+}
+
+// match photos to a GPX track. With "write": false (the default), only previews
+func (ph *PhotoHandler) Geotag(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		GPX       string `json:"gpx"`
+		Dir       string `json:"dir"`
+		Recursive bool   `json:"recursive"`
+		Offset    string `json:"offset"`  // duration, e.g. "-1h30m"
+		MaxGap    string `json:"max_gap"` // duration
+		Write     bool   `json:"write"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeFail(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if body.GPX == "" {
+		writeFail(w, http.StatusBadRequest, "missing gpx file")
+		return
+	}
+	gpx, ok := ph.s.libraryFile(body.GPX)
+	if !ok {
+		writeFail(w, http.StatusBadRequest, "gpx file expected in the photo or data directory")
+		return
+	}
+	req := photos.GeotagReq{
+		GPX:       gpx,
+		Dir:       body.Dir,
+		Recursive: body.Recursive,
+		Write:     body.Write,
+		Overwrite: body.Overwrite,
+	}
+	if body.Offset != "" {
+		d, err := time.ParseDuration(body.Offset)
+		if err != nil {
+			writeFail(w, http.StatusBadRequest, "offset expected to be a duration")
+			return
+		}
+		req.Offset = d
+	}
+	if body.MaxGap != "" {
+		d, err := time.ParseDuration(body.MaxGap)
+		if err != nil {
+			writeFail(w, http.StatusBadRequest, "max_gap expected to be a duration")
+			return
+		}
+		req.MaxGap = d
+	}
+
+	matches, err := ph.s.mgr.Geotag(r.Context(), req)
+	if err != nil {
+		logger.GetLog(r).WithError(err).Error("error geotagging photos")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"matches": matches,
+	})
+}
+
 type SockRequest struct {
 	Action string                 `json:"action"`
 	ID     string                 `json:"_id"`
@@ -124,6 +224,12 @@ type SockResponse struct {
 	Data  interface{} `json:"data,omitempty"`
 }
 
+// unrequested messages, pushed to the client
+type SockEvent struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
 func (ph *PhotoHandler) Websocket(w http.ResponseWriter, r *http.Request) {
 	log := logger.GetLog(r)
 	photoDir := r.Context().Value("photoDir").(string)
@@ -137,6 +243,23 @@ func (ph *PhotoHandler) Websocket(w http.ResponseWriter, r *http.Request) {
 	defer c.Close(websocket.StatusInternalError, "died.")
 	log.Debug("got websocket connection")
 
+	// push indexing progress as it happens
+	status := ph.s.mgr.Subscribe()
+	defer ph.s.mgr.Unsubscribe(status)
+	go func() {
+		for {
+			select {
+			case st := <-status:
+				if err := wsjson.Write(r.Context(), c, SockEvent{Event: "index_status", Data: st}); err != nil {
+					log.WithError(err).Debug("error pushing index status")
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
 	var req SockRequest
 	for {
 		_, rd, err := c.Reader(r.Context())
@@ -178,6 +301,8 @@ func (ph *PhotoHandler) Websocket(w http.ResponseWriter, r *http.Request) {
 			ascending := true
 			sort := ""
 			path := ""
+			cursor := ""
+			collapse := false
 			if of, ok := req.Params["offset"]; ok {
 				if ofint, ok := of.(float64); ok {
 					offset = int(ofint)
@@ -219,12 +344,30 @@ func (ph *PhotoHandler) Websocket(w http.ResponseWriter, r *http.Request) {
 					break
 				}
 			}
-			photos, dirs, err := ph.s.actions.List(r.Context(), ListReq{
-				Offset: offset,
-				Count:  count,
-				Asc:    ascending,
-				Sort:   sort,
-				Path:   path,
+			if cur, ok := req.Params["cursor"]; ok {
+				if c, ok := cur.(string); ok {
+					cursor = c
+				} else {
+					resp.Error = "cursor expected to be a string"
+					break
+				}
+			}
+			if col, ok := req.Params["collapse"]; ok {
+				if c, ok := col.(bool); ok {
+					collapse = c
+				} else {
+					resp.Error = "collapse expected to be a boolean"
+					break
+				}
+			}
+			photos, dirs, next, err := ph.s.actions.List(r.Context(), ListReq{
+				Offset:   offset,
+				Count:    count,
+				Asc:      ascending,
+				Sort:     sort,
+				Path:     path,
+				Cursor:   cursor,
+				Collapse: collapse,
 			})
 			if err != nil {
 				resp.Error = err.Error()
@@ -232,6 +375,7 @@ func (ph *PhotoHandler) Websocket(w http.ResponseWriter, r *http.Request) {
 				resp.Data = map[string]interface{}{
 					"photos": photos,
 					"dirs":   dirs,
+					"next":   next,
 				}
 			}
 			log.WithField("resp", resp).Trace("responding to list request")
@@ -334,13 +478,4 @@ func (ph *PhotoHandler) Websocket(w http.ResponseWriter, r *http.Request) {
 
 // ------------ helpers / internal funcs
 
-func thumbExt(filename string) string {
-	r := strings.NewReplacer(
-		".ARW", ".jpg",
-		".CR2", ".jpg",
-		".RAW", ".jpg",
-	)
-	return r.Replace(filename)
-}
-
 func gethost(ctx context.Context) string { return ctx.Value("host").(string) }
@@ -4,10 +4,13 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/geo"
 	"github.com/pzl/phumpkin/pkg/photos"
+	"github.com/pzl/phumpkin/pkg/query"
 )
 
 func AutoCompleteField(w http.ResponseWriter, r *http.Request) {
@@ -74,10 +77,59 @@ func AutoCompleteName(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, r, results)
 }
 
+// photos matching the words of ?q=, best first
+func SearchText(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	count := 30
+	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil {
+		count = c
+	}
+	offset := 0
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
+		offset = o
+	}
+
+	results, err := photos.TextSearch(r.Context(), q, offset, count)
+	if err != nil {
+		logger.GetLog(r).WithError(err).Error("error searching text")
+		writeErr(w, 500, err)
+		return
+	}
+	writeJSON(w, r, results)
+}
+
+// with ?bbox=west,south,east,north returns photos inside the box,
+// with ?lat=&lon=&radius= (meters) photos around a point, otherwise everything located
 func QueryLocations(w http.ResponseWriter, r *http.Request) {
 	log := logger.GetLog(r)
+	q := r.URL.Query()
 
-	p, err := photos.WithLocation(r.Context())
+	var p []photos.Photo
+	var err error
+	switch {
+	case q.Get("bbox") != "":
+		b, perr := geo.ParseBBox(q.Get("bbox"))
+		if perr != nil {
+			writeFail(w, 400, perr.Error())
+			return
+		}
+		p, err = photos.InBBox(r.Context(), b)
+	case q.Get("lat") != "" || q.Get("lon") != "":
+		lat, laErr := strconv.ParseFloat(q.Get("lat"), 64)
+		lon, loErr := strconv.ParseFloat(q.Get("lon"), 64)
+		radius, rErr := strconv.ParseFloat(q.Get("radius"), 64)
+		if laErr != nil || loErr != nil || lat < -90 || lat > 90 {
+			writeFail(w, 400, "lat and lon expected to be decimal degrees")
+			return
+		}
+		if rErr != nil || radius <= 0 {
+			writeFail(w, 400, "radius expected to be a positive number of meters")
+			return
+		}
+		p, err = photos.Near(r.Context(), lat, lon, radius)
+	default:
+		p, err = photos.WithLocation(r.Context())
+	}
 	if err != nil {
 		log.WithError(err).Error("error getting photos with locations")
 		writeErr(w, 500, err)
@@ -111,18 +163,15 @@ func QueryColorLabels(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	count := 30
-	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil {
-		count = c
-	}
-	offset := 0
-	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
-		offset = o
+	ps, next, err := pagePhotos(r, p)
+	if err != nil {
+		writePageErr(w, err)
+		return
 	}
-	ps := PhotoSort(r.URL.Query().Get("sort"), r.URL.Query().Get("sort_dir") != "desc", count, offset, p)
 
 	writeJSON(w, r, map[string]interface{}{
 		"photos": ps,
+		"next":   next,
 	})
 }
 
@@ -149,18 +198,15 @@ func QueryTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	count := 30
-	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil {
-		count = c
-	}
-	offset := 0
-	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
-		offset = o
+	ps, next, err := pagePhotos(r, p)
+	if err != nil {
+		writePageErr(w, err)
+		return
 	}
-	ps := PhotoSort(r.URL.Query().Get("sort"), r.URL.Query().Get("sort_dir") != "desc", count, offset, p)
 
 	writeJSON(w, r, map[string]interface{}{
 		"photos": ps,
+		"next":   next,
 	})
 
 }
@@ -175,18 +221,15 @@ func QueryFaces(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	count := 30
-	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil {
-		count = c
-	}
-	offset := 0
-	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
-		offset = o
+	ps, next, err := pagePhotos(r, p)
+	if err != nil {
+		writePageErr(w, err)
+		return
 	}
-	ps := PhotoSort(r.URL.Query().Get("sort"), r.URL.Query().Get("sort_dir") != "desc", count, offset, p)
 
 	writeJSON(w, r, map[string]interface{}{
 		"photos": ps,
+		"next":   next,
 	})
 
 }
@@ -213,17 +256,220 @@ func QueryRating(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ps, next, err := pagePhotos(r, p)
+	if err != nil {
+		writePageErr(w, err)
+		return
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"photos": ps,
+		"next":   next,
+	})
+}
+
+// ?path= limits to a directory, ?from= and ?to= (YYYY-MM-DD) to capture dates, to inclusive
+func QueryStats(w http.ResponseWriter, r *http.Request) {
+	log := logger.GetLog(r)
+	q := r.URL.Query()
+
+	sr := photos.StatsReq{Path: q.Get("path")}
+	if f := q.Get("from"); f != "" {
+		t, err := time.Parse("2006-01-02", f)
+		if err != nil {
+			writeFail(w, 400, "from expected to be a YYYY-MM-DD date")
+			return
+		}
+		sr.From = t
+	}
+	if f := q.Get("to"); f != "" {
+		t, err := time.Parse("2006-01-02", f)
+		if err != nil {
+			writeFail(w, 400, "to expected to be a YYYY-MM-DD date")
+			return
+		}
+		sr.To = t.AddDate(0, 0, 1)
+	}
+
+	st, err := photos.GetStats(r.Context(), sr)
+	if err != nil {
+		log.WithError(err).Error("error gathering stats")
+		writeErr(w, 500, err)
+		return
+	}
+	writeJSON(w, r, st)
+}
+
+// photos matching a query, see photos.Search
+func QuerySearch(w http.ResponseWriter, r *http.Request) {
+	log := logger.GetLog(r)
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		writeFail(w, http.StatusBadRequest, "missing query")
+		return
+	}
+
+	p, err := photos.Search(r.Context(), q)
+	if err != nil {
+		if qe, ok := err.(*query.Error); ok {
+			writeFail(w, http.StatusBadRequest, qe.Error())
+			return
+		}
+		log.WithError(err).Error("error searching photos")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	total := len(p)
+	ps, next, err := pagePhotos(r, p)
+	if err != nil {
+		writePageErr(w, err)
+		return
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"photos": ps,
+		"total":  total,
+		"next":   next,
+	})
+}
+
+// one page of query results, by ?sort= and ?sort_dir=. ?cursor= (the next
+// of the previous page) takes over from ?offset=. ?collapse=true shows only
+// the cover of each stack
+func pagePhotos(r *http.Request, p []photos.Photo) ([]photos.Photo, string, error) {
+	q := r.URL.Query()
+	lr := photos.ListReq{
+		Count:  30,
+		Sort:   q.Get("sort"),
+		Asc:    q.Get("sort_dir") != "desc",
+		Cursor: q.Get("cursor"),
+	}
+	lr.Collapse, _ = strconv.ParseBool(q.Get("collapse"))
+	if c, err := strconv.Atoi(q.Get("count")); err == nil {
+		lr.Count = c
+	}
+	if o, err := strconv.Atoi(q.Get("offset")); err == nil {
+		lr.Offset = o
+	}
+	return photos.Page(r.Context(), p, lr)
+}
+
+func writePageErr(w http.ResponseWriter, err error) {
+	if err == photos.ErrBadCursor {
+		writeFail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeErr(w, http.StatusInternalServerError, err)
+}
+
+// groups of byte-identical files, most wasted space first. ?offset= and
+// ?count= page through groups
+func QueryDuplicates(w http.ResponseWriter, r *http.Request) {
+	groups, err := photos.Duplicates(r.Context())
+	if err != nil {
+		logger.GetLog(r).WithError(err).Error("error finding duplicates")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	count := 30
-	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil {
+	if c, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && c > 0 {
 		count = c
 	}
 	offset := 0
-	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o > 0 {
 		offset = o
 	}
-	ps := PhotoSort(r.URL.Query().Get("sort"), r.URL.Query().Get("sort_dir") != "desc", count, offset, p)
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"groups": groups[min(offset, len(groups)):min(offset+count, len(groups))],
+		"total":  len(groups),
+		"wasted": wasted,
+	})
+}
+
+// photos that look like ?file=, closest first. ?distance= is how many bits
+// of the 64 bit perceptual hash may differ
+func QuerySimilar(w http.ResponseWriter, r *http.Request) {
+	file := r.URL.Query().Get("file")
+	if file == "" {
+		writeFail(w, http.StatusBadRequest, "missing file")
+		return
+	}
+	dist := photos.DefaultSimilarity
+	if d := r.URL.Query().Get("distance"); d != "" {
+		v, err := strconv.Atoi(d)
+		if err != nil || v < 0 || v > photos.MaxSimilarity {
+			writeFail(w, http.StatusBadRequest, "distance expected to be 0 to "+strconv.Itoa(photos.MaxSimilarity))
+			return
+		}
+		dist = v
+	}
+
+	ps, err := photos.Similar(r.Context(), file, dist)
+	if err == photos.ErrNotHashed {
+		writeFail(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		logger.GetLog(r).WithError(err).Error("error finding similar photos")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"photos": ps,
+	})
+}
 
+// groups of look-alike photos in the directory ?path=
+func QuerySimilarClusters(w http.ResponseWriter, r *http.Request) {
+	dist := photos.DefaultSimilarity
+	if d := r.URL.Query().Get("distance"); d != "" {
+		v, err := strconv.Atoi(d)
+		if err != nil || v < 0 || v > photos.MaxSimilarity {
+			writeFail(w, http.StatusBadRequest, "distance expected to be 0 to "+strconv.Itoa(photos.MaxSimilarity))
+			return
+		}
+		dist = v
+	}
+
+	clusters, err := photos.SimilarClusters(r.Context(), r.URL.Query().Get("path"), dist)
+	if err != nil {
+		logger.GetLog(r).WithError(err).Error("error clustering similar photos")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, map[string]interface{}{
+		"clusters": clusters,
+	})
+}
+
+// every photo of a stack, ?id=, in directory ?path=
+func QueryStack(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeFail(w, http.StatusBadRequest, "missing stack id")
+		return
+	}
+	p, err := photos.StackPhotos(r.Context(), r.URL.Query().Get("path"), id)
+	if err != nil {
+		logger.GetLog(r).WithError(err).Error("error getting stacked photos")
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ps, next, err := pagePhotos(r, p)
+	if err != nil {
+		writePageErr(w, err)
+		return
+	}
 	writeJSON(w, r, map[string]interface{}{
 		"photos": ps,
+		"total":  len(p),
+		"next":   next,
 	})
 }
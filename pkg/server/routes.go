@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -32,8 +34,14 @@ func (s *server) routes() {
 		v1.Mount("/photos", s.Photos())
 		v1.Mount("/query", s.Queries())
 		v1.Mount("/complete/", s.Typeahead())
+		v1.Mount("/index", s.Indexing())
+		v1.Mount("/admin", s.Admin())
+		v1.Get("/search", QuerySearch)
+		v1.Get("/search/text", SearchText)
+		v1.Get("/stats", QueryStats)
 		v1.Get("/thumb/{size}/*", s.PhotoHandler.GetThumb)
 		v1.Get("/ws", s.PhotoHandler.Websocket)
+		v1.With(s.RequireAdmin).Post("/geotag", s.PhotoHandler.Geotag) // reads and writes across the library
 
 	})
 
@@ -61,6 +69,26 @@ func (s server) InjectPaths(next http.Handler) http.Handler {
 	})
 }
 
+// only let requests carrying the admin token through, in X-Admin-Token
+// or as a bearer token. Without a token configured, nothing is
+func (s *server) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeFail(w, http.StatusForbidden, "admin routes are disabled, set an AdminToken to use them")
+			return
+		}
+		t := r.Header.Get("X-Admin-Token")
+		if t == "" {
+			t = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(t), []byte(s.adminToken)) != 1 {
+			writeFail(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *server) Photos() http.Handler {
 	r := chi.NewRouter()
 
@@ -70,6 +98,29 @@ func (s *server) Photos() http.Handler {
 	return r
 }
 
+func (s *server) Indexing() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/status", s.IndexHandler.Status)
+	r.Post("/", s.IndexHandler.Reindex)
+	r.Post("/reconcile", s.IndexHandler.Reconcile)
+
+	return r
+}
+
+func (s *server) Admin() http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.RequireAdmin)
+
+	r.Get("/backup", s.AdminHandler.Backup)
+	r.Post("/restore", s.AdminHandler.Restore)
+	r.Get("/export", s.AdminHandler.Export)
+	r.Get("/db", s.AdminHandler.DBStatus)
+	r.Post("/db/gc", s.AdminHandler.DBCollect)
+
+	return r
+}
+
 func (s *server) Typeahead() http.Handler {
 	r := chi.NewRouter()
 	r.Route("/{source}", func(rs chi.Router) {
@@ -88,6 +139,10 @@ func (s *server) Queries() http.Handler {
 	r.Get("/tags", QueryTags)
 	r.Get("/faces", QueryFaces)
 	r.Get("/rating", QueryRating)
+	r.Get("/duplicates", QueryDuplicates)
+	r.Get("/similar", QuerySimilar)
+	r.Get("/similar/clusters", QuerySimilarClusters)
+	r.Get("/stack", QueryStack)
 
 	return r
 }
@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"path/filepath"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"github.com/go-chi/chi"
 	"github.com/pzl/mstk"
 	"github.com/pzl/mstk/logger"
+	"github.com/pzl/phumpkin/pkg/geo"
+	"github.com/pzl/phumpkin/pkg/maint"
 	"github.com/pzl/phumpkin/pkg/photos"
 	"github.com/pzl/phumpkin/pkg/resize"
 	"github.com/sirupsen/logrus"
@@ -23,11 +26,16 @@ type server struct {
 	thumbDir     string
 	photoDir     string
 	dataDir      string
+	geoNames     string
+	adminToken   string // required by the admin routes and geotagging, which are off without one
 	db           *badger.DB
 	assets       http.Handler
 	router       *chi.Mux
 	PhotoHandler PhotoHandler
+	IndexHandler IndexHandler
+	AdminHandler AdminHandler
 	resizer      *resize.Resizer
+	maint        *maint.Maintainer
 	actions      Action
 	mgr          *photos.Mgr
 }
@@ -37,10 +45,14 @@ func New(options ...OptFunc) *server {
 		Server:  mstk.NewServer(),
 		router:  chi.NewRouter(),
 		resizer: resize.New(),
+		maint:   maint.New(),
 		mgr:     photos.New(),
 	}
 	s.PhotoHandler.s = s
+	s.IndexHandler.s = s
+	s.AdminHandler.s = s
 	s.actions.s = s
+	maint.Pause(s.mgr.Pause)(s.maint)
 	s.Server.Http.Handler = s.router
 	for _, o := range options {
 		if o != nil {
@@ -51,7 +63,24 @@ func New(options ...OptFunc) *server {
 }
 
 func (s *server) Start(ctx context.Context) (err error) {
+	c, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	// set server db before setting up routes, where ctx middleware will pick it up
+	s.routes()
+
+	if err := s.mgr.Start(c); err != nil {
+		return err
+	}
+	s.resizer.Start(c)
+	s.maint.Start(c)
+	return s.Server.Start(c)
+}
 
+// open the database and build the context everything runs under
+func (s *server) open(ctx context.Context) (context.Context, error) {
 	c := context.WithValue(ctx, "log", s.Log)
 	c = context.WithValue(c, "photoDir", s.photoDir)
 	c = context.WithValue(c, "dataDir", s.dataDir)
@@ -59,19 +88,21 @@ func (s *server) Start(ctx context.Context) (err error) {
 
 	db, err := badger.Open(badger.DefaultOptions(s.dataDir))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	s.db = db
 	c = context.WithValue(c, "badger", db)
 
-	// set server db before setting up routes, where ctx middleware will pick it up
-	s.routes()
-
-	if err := s.mgr.Start(c); err != nil {
-		return err
+	if s.geoNames != "" {
+		s.Log.WithField("file", s.geoNames).Info("loading reverse geocoding data")
+		g, err := geo.LoadGeoNames(s.geoNames)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		c = context.WithValue(c, "geocoder", g)
 	}
-	s.resizer.Start(c)
-	return s.Server.Start(c)
+	return c, nil
 }
 
 func (s *server) Shutdown(ctx context.Context) {
@@ -85,6 +116,22 @@ func Photos(d string) OptFunc       { return func(s *server) { s.photoDir = file
 func Thumbs(d string) OptFunc       { return func(s *server) { s.thumbDir = filepath.Clean(d) } }
 func DataDir(d string) OptFunc      { return func(s *server) { s.dataDir = filepath.Clean(d) } }
 func Assets(h http.Handler) OptFunc { return func(s *server) { s.assets = h } }
+func GeoNames(f string) OptFunc     { return func(s *server) { s.geoNames = f } }
+func AdminToken(t string) OptFunc   { return func(s *server) { s.adminToken = t } }
+
+// database garbage collection, see maint
+func GCInterval(d time.Duration) OptFunc { return func(s *server) { maint.Interval(d)(s.maint) } }
+func GCGrowth(b int64) OptFunc           { return func(s *server) { maint.Growth(b)(s.maint) } }
+
+// longest time between shots of a burst or bracket, see photos.StackGap
+func StackGap(d time.Duration) OptFunc { return func(s *server) { photos.StackGap(d)(s.mgr) } }
+
+// which of RAW+JPEG siblings stands for the photo, see photos.PreferSource
+func PreferSource(p string) OptFunc { return func(s *server) { photos.PreferSource(p)(s.mgr) } }
+
+// how to watch for changes and how often to poll, see photos.WatchMode
+func WatchMode(m string) OptFunc           { return func(s *server) { photos.WatchMode(m)(s.mgr) } }
+func PollInterval(d time.Duration) OptFunc { return func(s *server) { photos.PollInterval(d)(s.mgr) } }
 
 // easy http handler escape
 func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
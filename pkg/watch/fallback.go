@@ -0,0 +1,112 @@
+package watch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// inotify, polling the directories it has no watches left for
+type fallback struct {
+	notify *fsnotify.Watcher
+	poll   *Poller
+	events chan fsnotify.Event
+	errors chan error
+	done   chan struct{}
+	once   sync.Once
+
+	mu     sync.Mutex
+	polled map[string]bool
+	warned bool
+}
+
+func newFallback(interval time.Duration) (*fallback, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	f := &fallback{
+		notify: w,
+		poll:   NewPoller(interval),
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+		polled: make(map[string]bool),
+	}
+	go f.merge()
+	return f, nil
+}
+
+func (f *fallback) Add(dir string) error {
+	err := f.notify.Add(dir)
+	if err == nil || !isLimit(err) {
+		return err
+	}
+	f.mu.Lock()
+	f.polled[dir] = true
+	warn := !f.warned
+	f.warned = true
+	f.mu.Unlock()
+	if warn { // not from here, the caller may be the one reading errors
+		go func() {
+			select {
+			case f.errors <- ErrLimit:
+			case <-f.done:
+			}
+		}()
+	}
+	return f.poll.Add(dir)
+}
+
+func (f *fallback) Remove(dir string) error {
+	f.mu.Lock()
+	polled := f.polled[dir]
+	delete(f.polled, dir)
+	f.mu.Unlock()
+	if polled {
+		return f.poll.Remove(dir)
+	}
+	return f.notify.Remove(dir)
+}
+
+func (f *fallback) Events() <-chan fsnotify.Event { return f.events }
+func (f *fallback) Errors() <-chan error          { return f.errors }
+
+func (f *fallback) Close() error {
+	f.once.Do(func() { close(f.done) })
+	f.poll.Close() // nolint
+	return f.notify.Close()
+}
+
+// both watchers' events and errors as one
+func (f *fallback) merge() {
+	for {
+		var e fsnotify.Event
+		var err error
+		select {
+		case <-f.done:
+			return
+		case e = <-f.notify.Events:
+		case e = <-f.poll.Events():
+		case err = <-f.notify.Errors:
+		case err = <-f.poll.Errors():
+		}
+		if err != nil {
+			select {
+			case f.errors <- err:
+			case <-f.done:
+				return
+			}
+			continue
+		}
+		if e.Name == "" { // closed
+			continue
+		}
+		select {
+		case f.events <- e:
+		case <-f.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package watch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+	Polling.
+
+	Each watched directory is listed every interval, and compared with the
+	listing before it by name, size, modification time and type. New
+	names are Creates, changed files Writes. Names that went away are
+	sent as Renames, since a poll can't tell a move from a delete, and a
+	Rename lets a move be paired with its Create.
+
+	A file may still be being written when it's listed, so new and
+	changed files are held until a poll sees the same size and
+	modification time as the one before it, and only then sent. A file
+	that goes away while held as new is never sent at all. Directories
+	are sent right away, and so are new files with the size and
+	modification time of one that went away in the same poll, since they
+	were moved rather than written.
+
+	A poll sends every Rename before any Create, so a move between two
+	watched directories pairs whichever is listed first.
+*/
+
+type polled struct {
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+type Poller struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	closing  sync.Once
+
+	mu   sync.Mutex
+	dirs map[string]map[string]polled
+	held map[string]map[string]fsnotify.Op // files still changing, by dir
+}
+
+func NewPoller(interval time.Duration) *Poller {
+	p := &Poller{
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		dirs:     make(map[string]map[string]polled),
+		held:     make(map[string]map[string]fsnotify.Op),
+	}
+	go p.loop()
+	return p
+}
+
+// start polling dir. What's already there isn't sent
+func (p *Poller) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	list, err := listDir(dir)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.dirs[dir]; !ok {
+		p.dirs[dir] = list
+	}
+	return nil
+}
+
+func (p *Poller) Remove(dir string) error {
+	dir = filepath.Clean(dir)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.dirs[dir]; !ok {
+		return errors.New("can't remove non-existent poll watch for: " + dir)
+	}
+	delete(p.dirs, dir)
+	delete(p.held, dir)
+	return nil
+}
+
+func (p *Poller) Events() <-chan fsnotify.Event { return p.events }
+func (p *Poller) Errors() <-chan error          { return p.errors }
+
+func (p *Poller) Close() error {
+	p.closing.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *Poller) loop() {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		for _, e := range p.poll() {
+			select {
+			case p.events <- e:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// list every watched directory again, and what changed
+func (p *Poller) poll() []fsnotify.Event {
+	p.mu.Lock()
+	dirs := make([]string, 0, len(p.dirs))
+	for d := range p.dirs {
+		dirs = append(dirs, d)
+	}
+	p.mu.Unlock()
+	sort.Strings(dirs)
+
+	type file struct {
+		size int64
+		mod  int64
+	}
+	type arrival struct {
+		dir, name string
+		file
+	}
+	var gone, added, changed []fsnotify.Event
+	left := make(map[file]bool) // files that went away
+	var arrived []arrival       // files new this poll
+	for _, d := range dirs {
+		list, err := listDir(d)
+		p.mu.Lock()
+		was, ok := p.dirs[d]
+		switch {
+		case !ok: // removed meanwhile
+			p.mu.Unlock()
+			continue
+		case os.IsNotExist(err): // its parent sends it
+			delete(p.dirs, d)
+			delete(p.held, d)
+			p.mu.Unlock()
+			continue
+		case err != nil:
+			p.mu.Unlock()
+			select {
+			case p.errors <- err:
+			case <-p.done:
+			}
+			continue
+		}
+		p.dirs[d] = list
+		held := p.held[d]
+		if held == nil {
+			held = make(map[string]fsnotify.Op)
+			p.held[d] = held
+		}
+
+		for name, w := range was {
+			n, ok := list[name]
+			switch {
+			case !ok:
+				if held[name] != fsnotify.Create { // never sent, nothing to take back
+					gone = append(gone, fsnotify.Event{Name: filepath.Join(d, name), Op: fsnotify.Rename})
+					if !w.dir {
+						left[file{w.size, w.mod.UnixNano()}] = true
+					}
+				}
+				delete(held, name)
+			case n.dir != w.dir:
+				if held[name] != fsnotify.Create {
+					gone = append(gone, fsnotify.Event{Name: filepath.Join(d, name), Op: fsnotify.Remove})
+				}
+				delete(held, name)
+				if n.dir {
+					added = append(added, fsnotify.Event{Name: filepath.Join(d, name), Op: fsnotify.Create})
+				} else {
+					held[name] = fsnotify.Create
+				}
+			case n.dir:
+			case n.size != w.size || !n.mod.Equal(w.mod):
+				if held[name] != fsnotify.Create {
+					held[name] = fsnotify.Write
+				}
+			default: // still since the last poll
+				switch held[name] {
+				case fsnotify.Create:
+					added = append(added, fsnotify.Event{Name: filepath.Join(d, name), Op: fsnotify.Create})
+				case fsnotify.Write:
+					changed = append(changed, fsnotify.Event{Name: filepath.Join(d, name), Op: fsnotify.Write})
+				}
+				delete(held, name)
+			}
+		}
+		for name, n := range list {
+			if _, ok := was[name]; ok {
+				continue
+			}
+			if n.dir {
+				added = append(added, fsnotify.Event{Name: filepath.Join(d, name), Op: fsnotify.Create})
+			} else {
+				held[name] = fsnotify.Create
+				arrived = append(arrived, arrival{d, name, file{n.size, n.mod.UnixNano()}})
+			}
+		}
+		p.mu.Unlock()
+	}
+
+	// moved, not written
+	p.mu.Lock()
+	for _, a := range arrived {
+		if held, ok := p.held[a.dir]; ok && left[a.file] && held[a.name] == fsnotify.Create {
+			added = append(added, fsnotify.Event{Name: filepath.Join(a.dir, a.name), Op: fsnotify.Create})
+			delete(held, a.name)
+		}
+	}
+	p.mu.Unlock()
+	return append(append(gone, added...), changed...)
+}
+
+func listDir(dir string) (map[string]polled, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]polled, len(fis))
+	for _, fi := range fis {
+		list[fi.Name()] = polled{size: fi.Size(), mod: fi.ModTime(), dir: fi.IsDir()}
+	}
+	return list, nil
+}
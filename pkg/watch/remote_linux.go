@@ -0,0 +1,24 @@
+package watch
+
+import "syscall"
+
+// filesystem magic numbers, from statfs(2)
+var remoteFS = map[uint32]bool{
+	0x6969:     true, // nfs
+	0x517b:     true, // smb
+	0xff534d42: true, // cifs
+	0xfe534d42: true, // smb2
+	0x01021997: true, // 9p
+	0x00c36400: true, // ceph
+	0x65735546: true, // fuse, sshfs and friends
+}
+
+// whether dir is on a network filesystem, where inotify sees nothing
+// done by other machines
+func Remote(dir string) bool {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		return false
+	}
+	return remoteFS[uint32(s.Type)]
+}
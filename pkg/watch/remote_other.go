@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package watch
+
+// only known on linux, elsewhere pick Poll for network filesystems
+func Remote(dir string) bool { return false }
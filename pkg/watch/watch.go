@@ -0,0 +1,95 @@
+package watch
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+	Watching directories for changes.
+
+	inotify (through fsnotify) is cheap and immediate, but sees nothing
+	done to a network filesystem by another machine, and each user only
+	gets so many watches (fs.inotify.max_user_watches). Polling scans
+	each watched directory on an interval instead, and works anywhere.
+
+	Automatic mode polls network filesystems, and uses inotify elsewhere,
+	polling any directories past the watch limit.
+
+	Watchers watch single directories, not trees, and send fsnotify
+	events either way.
+*/
+
+const (
+	Auto   = "auto"
+	Notify = "notify"
+	Poll   = "poll"
+
+	DefaultInterval = 30 * time.Second
+)
+
+var ErrLimit = errors.New("inotify watch limit reached (fs.inotify.max_user_watches), polling directories past it")
+
+type Watcher interface {
+	Add(dir string) error
+	Remove(dir string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// a watcher for a tree at root. mode is Auto, Notify or Poll. Also
+// returns the mode used, which Auto works out
+func New(mode string, root string, interval time.Duration) (Watcher, string, error) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	switch mode {
+	case Poll:
+		return NewPoller(interval), Poll, nil
+	case Notify:
+		w, err := NewNotifier()
+		return w, Notify, err
+	case Auto, "":
+		if Remote(root) {
+			return NewPoller(interval), Poll, nil
+		}
+		w, err := newFallback(interval)
+		if err != nil { // out of inotify instances
+			return NewPoller(interval), Poll, nil
+		}
+		return w, Notify, nil
+	}
+	return nil, "", errors.New("unknown watch mode " + mode)
+}
+
+// whether err is inotify running out of watches
+func isLimit(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+// fsnotify behind the Watcher interface
+type notifier struct {
+	w *fsnotify.Watcher
+}
+
+func NewNotifier() (Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return notifier{w}, nil
+}
+
+func (n notifier) Add(dir string) error          { return n.w.Add(dir) }
+func (n notifier) Remove(dir string) error       { return n.w.Remove(dir) }
+func (n notifier) Events() <-chan fsnotify.Event { return n.w.Events }
+func (n notifier) Errors() <-chan error          { return n.w.Errors }
+func (n notifier) Close() error                  { return n.w.Close() }